@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Limits of a seed archive, an entry claiming more (or inflating to more)
+// is refused. The entries of a bundle are archives themselves.
+const (
+	seedMaxEntrySize   = 256 << 20
+	seedMaxArchiveSize = 1 << 30
+	seedMaxBundleSize  = 16 << 30
+)
+
+// archivePath is where the entry name of an archive lands below dst. Names
+// that are absolute or leave dst are refused.
+func archivePath(dst, name string) (path string, err error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || filepath.VolumeName(clean) != "" || strings.HasPrefix(name, "/") ||
+		clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		err = fmt.Errorf("invalid path in archive: %s", name)
+		return
+	}
+	path = filepath.Join(dst, clean)
+	return
+}
+
+// safeLink reports whether a symlink target stays below the folder of
+// the link. Targets are checked as written, not cleaned, so a link through
+// another link ("l/..") is refused as well.
+func safeLink(target string) bool {
+	if target == "" || filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+		return false
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(target), "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// extractZip writes the archive at zipPath into dst. Every entry is
+// checked before anything is written: no absolute or escaping paths, no
+// symlinks that may point out of dst and no entry above seedMaxEntrySize.
+func extractZip(zipPath, dst string) (err error) {
+	return unzip(zipPath, dst, seedMaxEntrySize, seedMaxArchiveSize)
+}
+
+// extractArchive writes the .zip, .tar or .tar.gz at path into dst with
+// the checks of extractZip, entries up to maxEntry bytes and maxTotal in
+// all.
+func extractArchive(path, dst string, maxEntry, maxTotal int64) (err error) {
+	name := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		err = unzip(path, dst, maxEntry, maxTotal)
+	case strings.HasSuffix(name, ".tar"), strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		err = extractTar(path, dst, maxEntry, maxTotal)
+	default:
+		err = fmt.Errorf("%s: unknown archive format, use .tar.gz, .tar or .zip", path)
+	}
+	return
+}
+
+func unzip(zipPath, dst string, maxEntry, maxTotal int64) (err error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+
+	var total uint64
+	for _, f := range zr.File {
+		if _, e := archivePath(dst, f.Name); e != nil {
+			return e
+		}
+		if f.UncompressedSize64 > uint64(maxEntry) {
+			return fmt.Errorf("%s: entry too large (%d bytes)", f.Name, f.UncompressedSize64)
+		}
+		if total += f.UncompressedSize64; total > uint64(maxTotal) {
+			return fmt.Errorf("%s: archive too large", zipPath)
+		}
+		if f.Mode()&os.ModeSymlink != 0 {
+			target, e := readZipFile(f)
+			if e != nil {
+				return e
+			}
+			if !safeLink(string(target)) {
+				return fmt.Errorf("%s: symlink may escape the archive: %s", f.Name, target)
+			}
+		}
+	}
+
+	for _, f := range zr.File {
+		path, _ := archivePath(dst, f.Name)
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(path, os.ModePerm)
+		case mode&os.ModeSymlink != 0:
+			err = extractSymlink(f, path)
+		case mode.IsRegular():
+			err = extractFile(f, path, maxEntry)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func extractSymlink(f *zip.File, path string) (err error) {
+	target, err := readZipFile(f)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return
+	}
+	err = os.Symlink(string(target), path)
+	return
+}
+
+func extractFile(f *zip.File, path string, maxEntry int64) (err error) {
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	// the size on the header may lie, never inflate more than the limit
+	r := io.LimitReader(rc, maxEntry+1)
+	if err = writeTarFile(r, path, f.Mode().Perm()|0600); err != nil {
+		return
+	}
+	if info, e := os.Lstat(path); e == nil && info.Size() > maxEntry {
+		err = fmt.Errorf("%s: entry too large", f.Name)
+	}
+	return
+}
+
+// extractTar is extractZip for tarballs, gzipped when the name says so.
+// The tarball is read twice: every header is checked before anything is
+// written. Entries other than folders, files and safe symlinks are
+// refused.
+func extractTar(path, dst string, maxEntry, maxTotal int64) (err error) {
+	each := func(fn func(hdr *tar.Header, tr *tar.Reader) error) (err error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if name := strings.ToLower(path); strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+			gz, e := gzip.NewReader(f)
+			if e != nil {
+				return e
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, e := tr.Next()
+			if e == io.EOF {
+				return
+			}
+			if e != nil {
+				return e
+			}
+			if err = fn(hdr, tr); err != nil {
+				return
+			}
+		}
+	}
+
+	check := func(hdr *tar.Header) (target string, err error) {
+		if target, err = archivePath(dst, hdr.Name); err != nil {
+			return
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg:
+		case tar.TypeSymlink:
+			if !safeLink(hdr.Linkname) {
+				err = fmt.Errorf("%s: symlink may escape the archive: %s", hdr.Name, hdr.Linkname)
+			}
+		default:
+			err = fmt.Errorf("%s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err == nil && hdr.Size > maxEntry {
+			err = fmt.Errorf("%s: entry too large (%d bytes)", hdr.Name, hdr.Size)
+		}
+		return
+	}
+
+	var total int64
+	err = each(func(hdr *tar.Header, _ *tar.Reader) error {
+		if _, e := check(hdr); e != nil {
+			return e
+		}
+		if total += hdr.Size; total > maxTotal {
+			return fmt.Errorf("%s: archive too large", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// the tarball is checked again as it is written, it may have changed
+	err = each(func(hdr *tar.Header, tr *tar.Reader) (err error) {
+		target, err := check(hdr)
+		if err != nil {
+			return
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.ModePerm)
+		case tar.TypeSymlink:
+			if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		default:
+			err = writeTarFile(io.LimitReader(tr, maxEntry), target, os.FileMode(hdr.Mode).Perm()|0600)
+		}
+		return
+	})
+	return
+}
+
+// replaceDir moves src to dst, an existing dst is only removed once src
+// is in place.
+func replaceDir(src, dst string) (err error) {
+	old := ""
+	if _, err = os.Lstat(dst); err == nil {
+		old = fmt.Sprintf("%s.old-%d", dst, os.Getpid())
+		if err = os.Rename(dst, old); err != nil {
+			return
+		}
+	}
+	if err = os.Rename(src, dst); err != nil {
+		if old != "" {
+			_ = os.Rename(old, dst)
+		}
+		return
+	}
+	if old != "" {
+		err = os.RemoveAll(old)
+	}
+	return
+}
+
+// replaceModule is replaceDir for the copy of a package: the folders of
+// nested modules (holding a go.mod) in dst that src has not are packages
+// of their own, they are moved over to src first and left as they are.
+func replaceModule(src, dst string) (err error) {
+	nested, err := nestedModules(dst)
+	if err != nil {
+		return
+	}
+	for _, rel := range nested {
+		to := filepath.Join(src, rel)
+		if _, e := os.Lstat(to); e == nil {
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+			return
+		}
+		if err = os.Rename(filepath.Join(dst, rel), to); err != nil {
+			return
+		}
+	}
+	err = replaceDir(src, dst)
+	return
+}
+
+// nestedModules lists the folders below dir holding a go.mod, relative to
+// dir. Nothing is listed below them.
+func nestedModules(dir string) (rels []string, err error) {
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() || p == dir {
+			return nil
+		}
+		if _, e := os.Stat(filepath.Join(p, goModFile)); e == nil {
+			rel, _ := filepath.Rel(dir, p)
+			rels = append(rels, rel)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return
+}
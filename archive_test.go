@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchivePath(t *testing.T) {
+	dst := filepath.FromSlash("/tmp/dst")
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"a.go", "/tmp/dst/a.go", true},
+		{"pkg/a.go", "/tmp/dst/pkg/a.go", true},
+		{"pkg/../a.go", "/tmp/dst/a.go", true},
+		{"./a.go", "/tmp/dst/a.go", true},
+		{"..a.go", "/tmp/dst/..a.go", true},
+		{"/etc/passwd", "", false},
+		{"/a.go", "", false},
+		{"..", "", false},
+		{"../a.go", "", false},
+		{"pkg/../../a.go", "", false},
+		{"pkg/../../../etc/passwd", "", false},
+	}
+	for _, tt := range tests {
+		path, err := archivePath(dst, tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("archivePath(%q) error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && path != filepath.FromSlash(tt.path) {
+			t.Errorf("archivePath(%q) = %q, want %q", tt.name, path, tt.path)
+		}
+	}
+}
+
+func TestSafeLink(t *testing.T) {
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"a.go", true},
+		{"pkg/a.go", true},
+		{"./a.go", true},
+		{"..a.go", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"..", false},
+		{"../a.go", false},
+		{"pkg/../a.go", false},
+		{"pkg/../../a.go", false},
+		{"l/..", false},
+	}
+	for _, tt := range tests {
+		if ok := safeLink(tt.target); ok != tt.ok {
+			t.Errorf("safeLink(%q) = %v, want %v", tt.target, ok, tt.ok)
+		}
+	}
+}
+
+// testEntry is an entry of an archive written by writeTestZip and
+// writeTestTar, a symlink when Link is set.
+type testEntry struct {
+	Name, Body, Link string
+	Type             byte
+}
+
+func writeTestZip(t *testing.T, path string, entries []testEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.Name, Method: zip.Deflate}
+		body := e.Body
+		switch {
+		case e.Link != "":
+			hdr.SetMode(os.ModeSymlink | 0777)
+			body = e.Link
+		case strings.HasSuffix(e.Name, "/"):
+			hdr.SetMode(os.ModeDir | 0755)
+		default:
+			hdr.SetMode(0644)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTar(t *testing.T, path string, entries []testEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0644, Typeflag: e.Type, Linkname: e.Link, Size: int64(len(e.Body))}
+		switch {
+		case hdr.Typeflag != 0:
+			hdr.Size = 0
+		case e.Link != "":
+			hdr.Typeflag, hdr.Size = tar.TypeSymlink, 0
+		case strings.HasSuffix(e.Name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		default:
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			if _, err = tw.Write([]byte(e.Body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var extractTests = []struct {
+	desc    string
+	entries []testEntry
+	files   map[string]string
+	err     string
+}{
+	{
+		desc: "files, folders and links",
+		entries: []testEntry{
+			{Name: "pkg/"},
+			{Name: "pkg/a.go", Body: "package pkg"},
+			{Name: "pkg/sub/b.go", Body: "package sub"},
+			{Name: "pkg/link.go", Link: "a.go"},
+		},
+		files: map[string]string{
+			"pkg/a.go":     "package pkg",
+			"pkg/sub/b.go": "package sub",
+			"pkg/link.go":  "package pkg",
+		},
+	},
+	{
+		desc:    "parent path",
+		entries: []testEntry{{Name: "pkg/a.go", Body: "a"}, {Name: "../evil.go", Body: "evil"}},
+		err:     "invalid path in archive",
+	},
+	{
+		desc:    "nested parent path",
+		entries: []testEntry{{Name: "pkg/../../evil.go", Body: "evil"}},
+		err:     "invalid path in archive",
+	},
+	{
+		desc:    "absolute path",
+		entries: []testEntry{{Name: "/tmp/evil.go", Body: "evil"}},
+		err:     "invalid path in archive",
+	},
+	{
+		desc:    "absolute symlink",
+		entries: []testEntry{{Name: "pkg/passwd", Link: "/etc/passwd"}},
+		err:     "symlink may escape",
+	},
+	{
+		desc:    "escaping symlink",
+		entries: []testEntry{{Name: "pkg/up", Link: "../.."}},
+		err:     "symlink may escape",
+	},
+	{
+		desc: "write through a symlink",
+		entries: []testEntry{
+			{Name: "pkg/l", Link: "sub/.."},
+			{Name: "pkg/l/../evil.go", Body: "evil"},
+		},
+		err: "symlink may escape",
+	},
+	{
+		desc:    "oversized entry",
+		entries: []testEntry{{Name: "big.go", Body: strings.Repeat("a", 65)}},
+		err:     "entry too large",
+	},
+	{
+		desc: "oversized archive",
+		entries: []testEntry{
+			{Name: "a.go", Body: strings.Repeat("a", 60)},
+			{Name: "b.go", Body: strings.Repeat("b", 60)},
+		},
+		err: "archive too large",
+	},
+}
+
+func testExtract(t *testing.T, ext string, write func(*testing.T, string, []testEntry)) {
+	for _, tt := range extractTests {
+		tmp, err := ioutil.TempDir("", "seed-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		path := filepath.Join(tmp, "archive"+ext)
+		write(t, path, tt.entries)
+		dst := filepath.Join(tmp, "dst")
+
+		err = extractArchive(path, dst, 64, 100)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s%s: error = %v, want %q", tt.desc, ext, err, tt.err)
+			}
+			if _, e := os.Stat(dst); !os.IsNotExist(e) {
+				t.Errorf("%s%s: wrote %s before refusing the archive", tt.desc, ext, dst)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s%s: %s", tt.desc, ext, err)
+			continue
+		}
+		for name, want := range tt.files {
+			b, err := ioutil.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+			if err != nil || string(b) != want {
+				t.Errorf("%s%s: %s = %q, %v, want %q", tt.desc, ext, name, b, err, want)
+			}
+		}
+	}
+}
+
+func TestExtractZip(t *testing.T) {
+	testExtract(t, ".zip", writeTestZip)
+}
+
+func TestExtractTar(t *testing.T) {
+	testExtract(t, ".tar", writeTestTar)
+
+	for _, typ := range []byte{tar.TypeLink, tar.TypeChar, tar.TypeFifo} {
+		tmp, err := ioutil.TempDir("", "seed-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		path := filepath.Join(tmp, "archive.tar")
+		writeTestTar(t, path, []testEntry{{Name: "pkg/x", Link: "/etc/passwd", Type: typ}})
+		err = extractArchive(path, filepath.Join(tmp, "dst"), 64, 100)
+		if err == nil || !strings.Contains(err.Error(), "unsupported entry type") {
+			t.Errorf("entry type %q: error = %v, want unsupported entry type", typ, err)
+		}
+	}
+}
+
+func TestExtractArchiveFormat(t *testing.T) {
+	if err := extractArchive("bundle.rar", "dst", 64, 100); err == nil {
+		t.Error("extractArchive(bundle.rar) succeeded, want unknown archive format")
+	}
+}
+
+// writeTestTree writes files, relative paths to contents, below dir.
+func writeTestTree(t *testing.T, dir string, files map[string]string) {
+	for name, body := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplaceModule(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "seed-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dst := filepath.Join(tmp, "vendor", "example.com", "a")
+	src := filepath.Join(tmp, "src")
+	// b is a module nested in a, copied on its own
+	writeTestTree(t, dst, map[string]string{
+		"go.mod":   "module example.com/a",
+		"old.go":   "package a",
+		"b/go.mod": "module example.com/a/b",
+		"b/b.go":   "package b",
+	})
+	writeTestTree(t, src, map[string]string{
+		"go.mod": "module example.com/a",
+		"a.go":   "package a",
+	})
+
+	if err = replaceModule(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		exists bool
+	}{
+		{"a.go", true},
+		{"old.go", false},
+		{"b/b.go", true},
+		{"b/go.mod", true},
+	}
+	for _, tt := range tests {
+		_, err := os.Stat(filepath.Join(dst, filepath.FromSlash(tt.name)))
+		if (err == nil) != tt.exists {
+			t.Errorf("%s exists = %v, want %v", tt.name, err == nil, tt.exists)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/archiver"
+	"github.com/nuveo/log"
+)
+
+// A bundle carries every package of a Seedfile to a machine without
+// network access (seed vendor --export, seed install --from-bundle). It is
+// a tarball of one folder:
+//
+//	seed-bundle/manifest.json                          the packages, see seedBundle
+//	seed-bundle/index/<org>/<name>/<version>.zip       seed archives, a file:// source
+//	seed-bundle/modules/<module>/@v/<version>.zip      proxy modules, a file:// proxy
+//	seed-bundle/git/<repo>.bundle                      a git bundle of the locked commit
+
+const (
+	seedBundleFolder   = "seed-bundle"
+	seedBundleManifest = "manifest.json"
+)
+
+// seedBundle is the manifest of a bundle: the lock it was exported from
+// with the archive of every package.
+type seedBundle struct {
+	Dependencies []string
+	Tests        bool
+	Packages     []seedBundlePackage
+}
+
+// seedBundlePackage is a locked package with the file of its archive in
+// the bundle and the "sha256:<hex>" of that file. Remote is where git
+// packages are fetched from once online again.
+type seedBundlePackage struct {
+	seedLockPackage
+	Path   string
+	SHA256 string
+	Remote string `json:",omitempty"`
+}
+
+func (b seedBundle) lock() (lock seedLock) {
+	lock.Dependencies = b.Dependencies
+	lock.Tests = b.Tests
+	for _, p := range b.Packages {
+		lock.Package = append(lock.Package, p.seedLockPackage)
+	}
+	return
+}
+
+// exportBundle writes every package dependencies resolve to into a bundle
+// at path. Seedfile.lock is used when it matches, otherwise dependencies
+// are resolved and copied to a throwaway folder first. It returns the
+// manifest of the bundle.
+func (s *seedInstall) exportBundle(dependencies []string, path string) (manifest seedBundle, err error) {
+	format := archiver.MatchingFormat(path)
+	if format == nil {
+		err = fmt.Errorf("%s: unknown bundle format, use .tar.gz, .tar or .zip", path)
+		return
+	}
+	if err = os.MkdirAll(SeedTempPath, os.ModePerm); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempDir(SeedTempPath, "bundle-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	lock, err := readLock(SeedLockFile)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err != nil || !lock.matches(dependencies, s.Tests) {
+		s.Folder = filepath.Join(tmp, "vendor")
+		if err = s.install(dependencies); err != nil {
+			return
+		}
+		lock = s.Lock
+		lock.Dependencies = dependencies
+		lock.Tests = s.Tests
+	}
+
+	root := filepath.Join(tmp, seedBundleFolder)
+	manifest = seedBundle{Dependencies: lock.Dependencies, Tests: lock.Tests}
+	var failed seedErrors
+	for _, p := range lock.Package {
+		b := seedBundlePackage{seedLockPackage: p}
+		var e error
+		switch {
+		case p.Revision != "":
+			e = bundleGit(root, &b)
+		case p.Sum != "":
+			e = bundleModule(root, &b)
+		default:
+			e = bundleSeed(root, &b)
+		}
+		if e == nil {
+			b.SHA256, e = archiveChecksum(filepath.Join(root, filepath.FromSlash(b.Path)))
+		}
+		if e != nil {
+			failed.add(p.Name, stageFetch, e)
+			continue
+		}
+		manifest.Packages = append(manifest.Packages, b)
+	}
+	if err = failed.err(); err != nil {
+		return
+	}
+
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(root, seedBundleManifest), b, 0644); err != nil {
+		return
+	}
+	os.Remove(path)
+	err = format.Make(path, []string{root})
+	return
+}
+
+// bundleSeed copies the archive of a seed package with its checksum and
+// signature, as `seed server` stores them.
+func bundleSeed(root string, b *seedBundlePackage) (err error) {
+	names := strings.Split(b.Name, "/")
+	if len(names) < 3 {
+		err = fmt.Errorf("invalid seed package: %s", b.Name)
+		return
+	}
+	zipPath, _, err := fetchSeed(names[1], names[2], b.Version)
+	if err != nil {
+		return
+	}
+	idx := &seedIndex{Root: filepath.Join(root, "index")}
+	if err = os.MkdirAll(idx.packagePath(names[1], names[2]), os.ModePerm); err != nil {
+		return
+	}
+	if err = copyFile(zipPath, idx.zipPath(names[1], names[2], b.Version)); err != nil {
+		return
+	}
+	sum, err := archiveChecksum(zipPath)
+	if err != nil {
+		return
+	}
+	pkg := seedIndexPackage{
+		Package:   seedPackage{Organization: names[1], Name: names[2], Version: b.Version},
+		Versions:  []string{b.Version},
+		Checksums: map[string]string{b.Version: sum},
+	}
+	if sig, e := ioutil.ReadFile(signaturePath(zipPath)); e == nil {
+		pkg.Signatures = map[string]string{b.Version: strings.TrimSpace(string(sig))}
+	}
+	if err = idx.savePackage(pkg); err != nil {
+		return
+	}
+	b.Path = fmt.Sprintf("index/%s/%s/%s.zip", names[1], names[2], b.Version)
+	return
+}
+
+// bundleModule copies the download of a proxy module.
+func bundleModule(root string, b *seedBundlePackage) (err error) {
+	if _, _, err = downloadModule(b.Name, b.Version, b.Sum); err != nil {
+		return
+	}
+	base, _ := moduleCachePaths(b.Name, b.Version)
+	rel := fmt.Sprintf("modules/%s/@v/%s", escapeModulePath(b.Name), escapeModulePath(b.Version))
+	dst := filepath.Join(root, filepath.FromSlash(rel))
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return
+	}
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if err = copyFile(base+ext, dst+ext); err != nil {
+			return
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(filepath.Dir(dst), "list"), []byte(b.Version+"\n"), 0644)
+	b.Path = rel + ".zip"
+	return
+}
+
+// bundleGit writes a git bundle of the locked commit and the tags on it.
+func bundleGit(root string, b *seedBundlePackage) (err error) {
+	mirror, repoRoot, err := gitMirror(b.Name)
+	if err != nil {
+		return
+	}
+	if remote, e := discoverRepo(b.Name); e == nil {
+		b.Remote = remote.URL
+	}
+	b.Path = fmt.Sprintf("git/%s.bundle", repoRoot)
+	dst, err := filepath.Abs(filepath.Join(root, filepath.FromSlash(b.Path)))
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return
+	}
+
+	// a bundle carries refs, the commit gets one for the time being
+	ref := fmt.Sprintf("refs/seed/%s", b.Revision)
+	if _, err = git(mirror, "update-ref", ref, b.Revision); err != nil {
+		return
+	}
+	defer git(mirror, "update-ref", "-d", ref)
+	args := []string{"bundle", "create", "-q", dst, ref}
+	tags, err := git(mirror, "tag", "--points-at", b.Revision)
+	if err != nil {
+		return
+	}
+	for _, tag := range strings.Fields(tags) {
+		args = append(args, fmt.Sprintf("refs/tags/%s", tag))
+	}
+	_, err = git(mirror, args...)
+	return
+}
+
+// readBundle unpacks the bundle at path into a temporary folder, with the
+// checks of extractZip, and checks every archive against the manifest.
+// Remove dir once done with it.
+func readBundle(path string) (dir string, manifest seedBundle, err error) {
+	if err = os.MkdirAll(SeedTempPath, os.ModePerm); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempDir(SeedTempPath, "bundle-")
+	if err != nil {
+		return
+	}
+	dir = filepath.Join(tmp, seedBundleFolder)
+	if err = extractArchive(path, tmp, seedMaxArchiveSize, seedMaxBundleSize); err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, seedBundleManifest))
+	if err != nil {
+		err = fmt.Errorf("%s: not a seed bundle: %s", path, err)
+		return
+	}
+	if err = json.Unmarshal(b, &manifest); err != nil {
+		err = fmt.Errorf("%s: invalid manifest: %s", path, err)
+		return
+	}
+
+	var failed seedErrors
+	for _, p := range manifest.Packages {
+		file, e := archivePath(dir, p.Path)
+		if e == nil {
+			var sum string
+			if sum, e = archiveChecksum(file); e == nil && sum != p.SHA256 {
+				e = &seedChecksumError{Key: p.Path, Source: path, Expected: p.SHA256, Got: sum}
+			}
+		}
+		failed.add(p.Name, stageVerify, e)
+	}
+	err = failed.err()
+	return
+}
+
+// importGitBundle adds the commit of a git package to its mirror, creating
+// the mirror (pointing to the package remote) when missing.
+func importGitBundle(dir string, p seedBundlePackage) (err error) {
+	root := strings.TrimSuffix(strings.TrimPrefix(p.Path, "git/"), ".bundle")
+	mirror, err := archivePath(filepath.Join(SeedCachePath, "git"), root+".git")
+	if err != nil {
+		return
+	}
+	bundle, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(p.Path)))
+	if err != nil {
+		return
+	}
+
+	unlock := lockRepo(root)
+	defer unlock()
+	if _, err = os.Stat(mirror); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(mirror), os.ModePerm); err != nil {
+			return
+		}
+		if _, err = git("", "init", "-q", "--bare", mirror); err != nil {
+			return
+		}
+		if p.Remote != "" {
+			if _, err = git(mirror, "remote", "add", "--mirror=fetch", "origin", p.Remote); err != nil {
+				return
+			}
+		}
+	} else if err != nil {
+		return
+	}
+	_, err = git(mirror, "fetch", "-q", bundle, "+refs/*:refs/*")
+	return
+}
+
+// fromBundle installs exactly the packages of the bundle at path without
+// touching the network, the bundle is the only source and proxy. It
+// returns the lock of the bundle.
+func (s *seedInstall) fromBundle(path string) (lock seedLock, err error) {
+	dir, manifest, err := readBundle(path)
+	if dir != "" {
+		defer os.RemoveAll(filepath.Dir(dir))
+	}
+	if err != nil {
+		return
+	}
+
+	var failed seedErrors
+	modules := false
+	for _, p := range manifest.Packages {
+		switch {
+		case p.Revision != "":
+			failed.add(p.Name, stageFetch, importGitBundle(dir, p))
+		case p.Sum != "":
+			modules = true
+		}
+	}
+	if err = failed.err(); err != nil {
+		return
+	}
+
+	SeedOffline = true
+	SeedSources = append([]seedClient{{URL: fmt.Sprintf("file://%s", filepath.Join(dir, "index"))}}, SeedSources...)
+	if modules {
+		SeedProxy = fmt.Sprintf("file://%s", filepath.Join(dir, "modules"))
+	}
+	// the checksums of the bundle were computed with or without tests
+	if s.Tests != manifest.Tests {
+		log.Warningf("%s was exported with tests = %v, installed as exported\n", path, manifest.Tests)
+	}
+	s.Tests = manifest.Tests
+	lock = manifest.lock()
+	log.Debugf("%s: %d package(s)\n", path, len(lock.Package))
+	err = s.fromLock(lock)
+	return
+}
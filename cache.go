@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of what the seed cache holds.
+const (
+	cacheSeed    = "seed"    // <cache>/<org>-<name>-<version>.zip with its checksum and signature
+	cachePartial = "partial" // <cache>/<...>.zip.part, an unfinished download
+	cacheGit     = "git"     // <cache>/git/<repo>.git, a bare mirror
+	cacheSrc     = "src"     // <cache>/src/<repo>@<commit>, an exported revision
+	cacheMod     = "mod"     // <cache>/mod/<module>@<version> with its download from a proxy
+	cacheTmp     = "tmp"     // anything left on ~/.seed/tmp
+)
+
+// seedCacheEntry is one item of the cache, Paths are removed together.
+// Used is the last time seed used it.
+type seedCacheEntry struct {
+	Kind  string
+	Name  string
+	Paths []string
+	Size  int64
+	Used  time.Time
+}
+
+// touchCache marks a cache entry as used now, clean by age keeps it.
+func touchCache(path string) {
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+}
+
+// cacheEntries lists everything on the cache and temp folders, sorted by
+// kind and name.
+func cacheEntries() (entries []seedCacheEntry, err error) {
+	files, err := ioutil.ReadDir(SeedCachePath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	for _, f := range files {
+		path := filepath.Join(SeedCachePath, f.Name())
+		switch {
+		case f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".zip"):
+			e := seedCacheEntry{Kind: cacheSeed, Name: strings.TrimSuffix(f.Name(), ".zip"), Used: f.ModTime()}
+			for _, p := range []string{path, checksumPath(path), signaturePath(path)} {
+				if info, e2 := os.Stat(p); e2 == nil {
+					e.Paths = append(e.Paths, p)
+					e.Size += info.Size()
+				}
+			}
+			entries = append(entries, e)
+		case f.Mode().IsRegular() && strings.HasSuffix(f.Name(), ".part"):
+			entries = append(entries, seedCacheEntry{
+				Kind:  cachePartial,
+				Name:  strings.TrimSuffix(f.Name(), ".zip.part"),
+				Paths: []string{path},
+				Size:  f.Size(),
+				Used:  f.ModTime(),
+			})
+		}
+	}
+
+	git, err := cacheDirs(cacheGit, filepath.Join(SeedCachePath, "git"), func(name string) bool {
+		return strings.HasSuffix(name, ".git")
+	})
+	if err != nil {
+		return
+	}
+	src, err := cacheDirs(cacheSrc, filepath.Join(SeedCachePath, "src"), func(name string) bool {
+		return strings.Contains(name, "@")
+	})
+	if err != nil {
+		return
+	}
+	mod, err := cacheDirs(cacheMod, filepath.Join(SeedCachePath, "mod"), func(name string) bool {
+		return strings.Contains(name, "@")
+	})
+	if err != nil {
+		return
+	}
+	for i, e := range mod {
+		names := strings.SplitN(e.Name, "@", 2)
+		base := filepath.Join(SeedCachePath, "download", filepath.FromSlash(names[0]), "@v", names[1])
+		for _, ext := range []string{".info", ".mod", ".zip", ".ziphash"} {
+			if info, e2 := os.Stat(base + ext); e2 == nil {
+				mod[i].Paths = append(mod[i].Paths, base+ext)
+				mod[i].Size += info.Size()
+			}
+		}
+	}
+	entries = append(append(append(entries, git...), src...), mod...)
+
+	tmp, err := ioutil.ReadDir(SeedTempPath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+	for _, f := range tmp {
+		path := filepath.Join(SeedTempPath, f.Name())
+		size, e := dirSize(path)
+		if e != nil {
+			err = e
+			return
+		}
+		entries = append(entries, seedCacheEntry{Kind: cacheTmp, Name: f.Name(), Paths: []string{path}, Size: size, Used: f.ModTime()})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return
+}
+
+// cacheDirs finds the folders below root whose name matches, named by
+// their path relative to root.
+func cacheDirs(kind, root string, match func(name string) bool) (entries []seedCacheEntry, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() || path == root || !match(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, seedCacheEntry{
+			Kind:  kind,
+			Name:  strings.TrimSuffix(filepath.ToSlash(rel), ".git"),
+			Paths: []string{path},
+			Size:  size,
+			Used:  info.ModTime(),
+		})
+		return filepath.SkipDir
+	})
+	return
+}
+
+func dirSize(path string) (size int64, err error) {
+	err = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// matches reports whether the entry belongs to pkg, a repository root
+// ("github.com/user/repo") or a seed package ("goseed.io/org/name").
+func (e seedCacheEntry) matches(pkg string) bool {
+	switch e.Kind {
+	case cacheSeed, cachePartial:
+		names := strings.Split(pkg, "/")
+		return len(names) == 3 && isSeedPackage(pkg) && strings.HasPrefix(e.Name, fmt.Sprintf("%s-%s-", names[1], names[2]))
+	case cacheGit:
+		return e.Name == pkg
+	case cacheSrc:
+		return strings.SplitN(e.Name, "@", 2)[0] == pkg
+	case cacheMod:
+		return strings.SplitN(e.Name, "@", 2)[0] == escapeModulePath(pkg)
+	}
+	return false
+}
+
+func (e seedCacheEntry) remove() (err error) {
+	for _, p := range e.Paths {
+		if err = os.RemoveAll(p); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// verify checks a seed archive (or module zip) against the checksum
+// recorded when it was downloaded, other entries have nothing to check.
+func (e seedCacheEntry) verify() (checked bool, err error) {
+	if e.Kind == cacheMod {
+		return e.verifyModule()
+	}
+	if e.Kind != cacheSeed {
+		return
+	}
+	zipPath := e.Paths[0]
+	b, err := ioutil.ReadFile(checksumPath(zipPath))
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	checked = true
+	sum, err := archiveChecksum(zipPath)
+	if err != nil {
+		return
+	}
+	if expected := strings.TrimSpace(string(b)); expected != sum {
+		err = &seedChecksumError{Key: e.Name, Source: "cache", Expected: expected, Got: sum}
+	}
+	return
+}
+
+// parseAge reads a duration as time.ParseDuration does, also accepting
+// days: "30d", "12h", "1d12h". Only ages above zero are valid.
+func parseAge(s string) (age time.Duration, err error) {
+	invalid := fmt.Errorf("invalid age: %s", s)
+	rest := s
+	if i := strings.Index(rest, "d"); i > 0 {
+		var days int
+		if _, e := fmt.Sscanf(rest[:i], "%d", &days); e != nil {
+			return 0, invalid
+		}
+		age = time.Duration(days) * 24 * time.Hour
+		rest = rest[i+1:]
+	}
+	if rest != "" {
+		d, e := time.ParseDuration(rest)
+		if e != nil {
+			return 0, invalid
+		}
+		age += d
+	}
+	if age <= 0 {
+		return 0, invalid
+	}
+	return
+}
+
+func (e seedCacheEntry) verifyModule() (checked bool, err error) {
+	names := strings.SplitN(e.Name, "@", 2)
+	modPath, err := unescapeModulePath(names[0])
+	if err != nil {
+		return
+	}
+	version, err := unescapeModulePath(names[1])
+	if err != nil {
+		return
+	}
+	base, _ := moduleCachePaths(modPath, version)
+	b, err := ioutil.ReadFile(base + ".ziphash")
+	if os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	checked = true
+	sum, err := hashModuleZip(base+".zip", modPath, version)
+	if err != nil {
+		return
+	}
+	if expected := strings.TrimSpace(string(b)); expected != sum {
+		err = &seedChecksumError{Key: e.Name, Source: "cache", Expected: expected, Got: sum}
+	}
+	return
+}
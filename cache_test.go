@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"30d", 30 * 24 * time.Hour, true},
+		{"12h", 12 * time.Hour, true},
+		{"1d12h", 36 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"0", 0, false},
+		{"0d", 0, false},
+		{"-1h", 0, false},
+		{"-5d", 0, false},
+		{"1d-30h", 0, false},
+		{"", 0, false},
+		{"d", 0, false},
+		{"xd", 0, false},
+		{"week", 0, false},
+	}
+	for _, tt := range tests {
+		age, err := parseAge(tt.in)
+		if (err == nil) != tt.ok || age != tt.want {
+			t.Errorf("parseAge(%q) = %s, %v, want %s, ok %v", tt.in, age, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// seedClient talks to a Seed Index Server (see server.go). Username and
+// Password are sent as basic auth for indexes behind a proxy.
+type seedClient struct {
+	URL      string
+	Token    string
+	Username string
+	Password string
+}
+
+var seedHTTPClient = &http.Client{Timeout: 5 * time.Minute}
+
+func (c seedClient) url(path string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(c.URL, "/"), strings.TrimLeft(path, "/"))
+}
+
+// do sends in as JSON and decodes the answer into out, any non 2xx
+// status is returned as an error carrying the server message.
+func (c seedClient) do(method, path string, in, out interface{}) (err error) {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	err = c.send(method, path, contentType, body, out)
+	return
+}
+
+// send is do for a body of any type. The token goes on the Authorization
+// header, or on Seed-Token when that header carries basic auth.
+func (c seedClient) send(method, path, contentType string, body io.Reader, out interface{}) (err error) {
+	req, err := http.NewRequest(method, c.url(path), body)
+	if err != nil {
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+		if c.Token != "" {
+			req.Header.Set("Seed-Token", c.Token)
+		}
+	case c.Token != "":
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	}
+	resp, err := seedHTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if err = c.checkStatus(resp); err != nil {
+		return
+	}
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return
+}
+
+// seedStatusError is returned for non 2xx answers of an index.
+type seedStatusError struct {
+	URL        string
+	Message    string
+	StatusCode int
+}
+
+func (e *seedStatusError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.URL, e.Message, e.StatusCode)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*seedStatusError)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+func (c seedClient) checkStatus(resp *http.Response) (err error) {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return
+	}
+	var msg seedResponse
+	if json.NewDecoder(resp.Body).Decode(&msg) != nil || msg.Message == "" {
+		msg.Message = http.StatusText(resp.StatusCode)
+	}
+	err = &seedStatusError{URL: c.URL, Message: msg.Message, StatusCode: resp.StatusCode}
+	return
+}
+
+// Push uploads the archive at zipPath with its metadata as a multipart
+// form: the "package" field holds push as JSON, the "file" field the
+// archive. The archive is streamed from disk.
+func (c seedClient) Push(push seedPush, zipPath string) (resp seedResponse, err error) {
+	f, err := os.Open(zipPath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writePush(mw, push, f))
+	}()
+	err = c.send(http.MethodPost, "push", mw.FormDataContentType(), pr, &resp)
+	return
+}
+
+func writePush(mw *multipart.Writer, push seedPush, file io.Reader) (err error) {
+	part, err := mw.CreateFormField("package")
+	if err != nil {
+		return
+	}
+	if err = json.NewEncoder(part).Encode(push); err != nil {
+		return
+	}
+	part, err = mw.CreateFormFile("file", fmt.Sprintf("%s.zip", push.Package.PackageFullName()))
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(part, file); err != nil {
+		return
+	}
+	err = mw.Close()
+	return
+}
+
+func (c seedClient) Register(reg seedRegister) (resp seedResponse, err error) {
+	err = c.do(http.MethodPost, "register", reg, &resp)
+	return
+}
+
+func (c seedClient) Search(query string) (results []seedSearchResult, err error) {
+	err = c.do(http.MethodGet, fmt.Sprintf("search?q=%s", url.QueryEscape(query)), nil, &results)
+	return
+}
+
+func (c seedClient) Package(org, name string) (pkg seedIndexPackage, err error) {
+	if idx, ok := c.local(); ok {
+		return c.localPackage(idx, org, name)
+	}
+	err = c.do(http.MethodGet, fmt.Sprintf("packages/%s/%s", org, name), nil, &pkg)
+	return
+}
+
+// local returns the index of a file:// source, a folder laid out as the
+// storage of `seed server` (a copy of ~/.seed/server for instance).
+func (c seedClient) local() (idx *seedIndex, ok bool) {
+	if !strings.HasPrefix(c.URL, "file://") {
+		return
+	}
+	idx, ok = &seedIndex{Root: strings.TrimPrefix(c.URL, "file://")}, true
+	return
+}
+
+// localPackage reads the metadata of a package as /packages/ serves it.
+func (c seedClient) localPackage(idx *seedIndex, org, name string) (pkg seedIndexPackage, err error) {
+	if err = validIndexPath(org, name); err == nil {
+		pkg, err = idx.loadPackage(org, name)
+	}
+	if err != nil {
+		err = &seedStatusError{URL: c.URL, Message: fmt.Sprintf("package %s/%s not found", org, name), StatusCode: http.StatusNotFound}
+		return
+	}
+	pkg.Owner = ""
+	checksums := map[string]string{}
+	for _, v := range pkg.Versions {
+		if sum, e := idx.checksum(pkg, v); e == nil {
+			checksums[v] = sum
+		}
+	}
+	pkg.Checksums = checksums
+	return
+}
+
+// Headers carrying the checksum and signature of a downloaded archive.
+const (
+	seedChecksumHeader  = "Seed-Checksum"
+	seedSignatureHeader = "Seed-Signature"
+)
+
+// seedArchiveInfo is what an index publishes about an archive, fields are
+// empty when unknown (older indexes, unsigned packages). Offset is where
+// the body starts in the archive, Size the archive size or -1.
+type seedArchiveInfo struct {
+	Checksum  string
+	Signature string
+	Offset    int64
+	Size      int64
+}
+
+// Archive opens the archive of org/name@version from offset on. The index
+// may ignore the range and send the whole archive, check info.Offset.
+func (c seedClient) Archive(org, name, version string, offset int64) (body io.ReadCloser, info seedArchiveInfo, err error) {
+	if idx, ok := c.local(); ok {
+		return c.localArchive(idx, org, name, version, offset)
+	}
+	req, err := http.NewRequest(http.MethodGet, c.url(fmt.Sprintf("packages/%s/%s/%s.zip", org, name, version)), nil)
+	if err != nil {
+		return
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := seedHTTPClient.Do(req)
+	if err != nil {
+		return
+	}
+	if err = c.checkStatus(resp); err != nil {
+		resp.Body.Close()
+		return
+	}
+	info.Checksum = resp.Header.Get(seedChecksumHeader)
+	info.Signature = resp.Header.Get(seedSignatureHeader)
+	info.Size = resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		info.Offset = offset
+		var end int64
+		if _, e := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &info.Offset, &end, &info.Size); e != nil {
+			info.Size = -1
+		}
+	}
+	body = resp.Body
+	return
+}
+
+func (c seedClient) localArchive(idx *seedIndex, org, name, version string, offset int64) (body io.ReadCloser, info seedArchiveInfo, err error) {
+	pkg, err := c.localPackage(idx, org, name)
+	if err != nil {
+		return
+	}
+	var f *os.File
+	if err = validIndexPath(version); err == nil {
+		f, err = os.Open(idx.zipPath(org, name, version))
+	}
+	if err != nil {
+		err = &seedStatusError{URL: c.URL, Message: fmt.Sprintf("version %s of %s/%s not found", version, org, name), StatusCode: http.StatusNotFound}
+		return
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return
+	}
+	info = seedArchiveInfo{Checksum: pkg.Checksums[version], Signature: pkg.Signatures[version], Size: st.Size()}
+	if offset > 0 && offset <= st.Size() {
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return
+		}
+		info.Offset = offset
+	}
+	body = f
+	return
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nuveo/log"
+	"github.com/urfave/cli"
+)
+
+var SeedRCPath = fmt.Sprintf("%s/.seedrc", os.Getenv("HOME"))
+
+// seedSettings is the [seed] section of ~/.seedrc, a Seedfile may carry
+// the same section to override it per project.
+type seedSettings struct {
+	Path       string
+	Verbose    bool
+	Sources    []string
+	Key        string
+	Signatures string
+	Proxy      string
+}
+
+// seedSource holds the credentials of an index, keyed on ~/.seedrc by
+// its host (or full URL).
+type seedSource struct {
+	Token    string
+	Username string
+	Password string
+}
+
+type seedRC struct {
+	Seed   seedSettings
+	Source map[string]seedSource
+	Trust  map[string][]string
+}
+
+// loadConfig reads ~/.seedrc and then the project Seedfile, values set on
+// the Seedfile win, except for signatures: a Seedfile may only make the
+// policy stricter and trust keys for organizations ~/.seedrc has none
+// for. A missing file is not an error, check the returned found flag to
+// warn about a missing Seedfile.
+func loadConfig(seedfile string) (config SeedConfig, found bool, err error) {
+	var rc seedRC
+	_, err = decodeOptional(SeedRCPath, &rc)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", SeedRCPath, err)
+		return
+	}
+
+	meta, err := decodeOptional(seedfile, &config)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", seedfile, err)
+		return
+	}
+	found = meta != nil
+
+	project := config.Seed
+	config.Seed = rc.Seed
+	if project.Path != "" {
+		config.Seed.Path = project.Path
+	}
+	if meta != nil && meta.IsDefined("seed", "verbose") {
+		config.Seed.Verbose = project.Verbose
+	}
+	if len(project.Sources) > 0 {
+		config.Seed.Sources = project.Sources
+	}
+	if project.Key != "" {
+		config.Seed.Key = project.Key
+	}
+	if project.Signatures != "" {
+		if signaturesRank(project.Signatures) >= signaturesRank(config.Seed.Signatures) {
+			config.Seed.Signatures = project.Signatures
+		} else {
+			log.Warningf("%s: signatures = %q is weaker than %q of %s, ignored\n", seedfile, project.Signatures, config.Seed.Signatures, SeedRCPath)
+		}
+	}
+	if project.Proxy != "" {
+		config.Seed.Proxy = project.Proxy
+	}
+	if len(config.Seed.Sources) == 0 {
+		config.Seed.Sources = []string{DefaultIndex}
+	}
+
+	sources := map[string]seedSource{}
+	for k, v := range rc.Source {
+		sources[k] = v
+	}
+	for k, v := range config.Source {
+		sources[k] = v
+	}
+	config.Source = sources
+
+	trust := map[string][]string{}
+	for org, keys := range rc.Trust {
+		trust[org] = keys
+	}
+	for org, keys := range config.Trust {
+		if _, ok := rc.Trust[org]; ok {
+			log.Warningf("%s: [trust] %s is set on %s, ignored\n", seedfile, org, SeedRCPath)
+			continue
+		}
+		trust[org] = keys
+	}
+	config.Trust = trust
+	return
+}
+
+func decodeOptional(path string, v interface{}) (meta *toml.MetaData, err error) {
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		err = nil
+		return
+	}
+	md, err := toml.DecodeFile(path, v)
+	if err != nil {
+		return
+	}
+	meta = &md
+	return
+}
+
+// apply points the seed folders, log level, sources, module proxy and
+// signature policy to the loaded settings.
+func (c SeedConfig) apply() (err error) {
+	s := c.Seed
+	if s.Path != "" {
+		SeedPath = strings.TrimRight(expandHome(s.Path), "/")
+		SeedCachePath = fmt.Sprintf("%s/cache", SeedPath)
+		SeedTempPath = fmt.Sprintf("%s/tmp", SeedPath)
+		SeedServerPath = fmt.Sprintf("%s/server", SeedPath)
+		SeedKeyPath = fmt.Sprintf("%s/seed.key", SeedPath)
+	}
+	if s.Key != "" {
+		SeedKeyPath = expandHome(s.Key)
+	}
+	log.DebugMode = s.Verbose
+	setProxy(s.Proxy)
+
+	SeedSources = nil
+	for _, source := range s.Sources {
+		SeedSources = append(SeedSources, c.client(source))
+	}
+	err = applyTrust(s.Signatures, c.Trust)
+	return
+}
+
+func expandHome(path string) string {
+	path = os.ExpandEnv(path)
+	if strings.HasPrefix(path, "~/") {
+		path = fmt.Sprintf("%s/%s", os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
+
+// credentials finds the [source] entry of an index by URL or host.
+func (c SeedConfig) credentials(index string) (src seedSource) {
+	if s, ok := c.Source[index]; ok {
+		return s
+	}
+	if s, ok := c.Source[strings.TrimRight(index, "/")]; ok {
+		return s
+	}
+	if u, err := url.Parse(index); err == nil {
+		if s, ok := c.Source[u.Host]; ok {
+			return s
+		}
+	}
+	return
+}
+
+// client returns a seedClient for index with its configured credentials.
+func (c SeedConfig) client(index string) seedClient {
+	src := c.credentials(index)
+	return seedClient{
+		URL:      index,
+		Token:    src.Token,
+		Username: src.Username,
+		Password: src.Password,
+	}
+}
+
+// indexClient builds the client for commands using indexFlags, the first
+// configured source is the default index.
+func (c SeedConfig) indexClient(ctx *cli.Context) (client seedClient) {
+	index := ctx.String("index")
+	if index == "" {
+		index = c.Seed.Sources[0]
+	}
+	client = c.client(index)
+	if ctx.String("token") != "" {
+		client.Token = ctx.String("token")
+	}
+	return
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nuveo/log"
+)
+
+// seedDownloadAttempts is how many times a download is tried on network
+// and server errors, waiting seedRetryDelay (doubled every time) between
+// attempts. Every attempt resumes where the last one stopped.
+var (
+	seedDownloadAttempts = 4
+	seedRetryDelay       = time.Second
+)
+
+// partPath is where an archive is downloaded to before it is complete
+// and verified, it survives failed runs so the next one resumes it.
+func partPath(zipPath string) string {
+	return fmt.Sprintf("%s.part", zipPath)
+}
+
+// retryable tells network and server errors, worth trying again, from
+// answers like 404 that will not change.
+func retryable(err error) bool {
+	e, ok := err.(*seedStatusError)
+	return !ok || e.StatusCode >= 500
+}
+
+// downloadSeed saves the archive of org/name@version from source to
+// zipPath, checking it against the checksum the source publishes and the
+// Seedfile pins. The checksum is kept next to the archive to verify it on
+// later runs. The archive only appears on zipPath once verified.
+func downloadSeed(source seedClient, org, name, version, zipPath string) (err error) {
+	unlock := lockRepo(zipPath)
+	defer unlock()
+	if _, err = os.Stat(zipPath); err == nil {
+		// downloaded meanwhile
+		err = verifyArchive(zipPath, org, name, version)
+		return
+	}
+
+	key := seedKey(org, name, version)
+	part := partPath(zipPath)
+	var published seedArchiveInfo
+	delay := seedRetryDelay
+	for attempt := 1; ; attempt++ {
+		published, err = downloadPart(source, org, name, version, part)
+		if err == nil || !retryable(err) || attempt == seedDownloadAttempts {
+			break
+		}
+		log.Warningf("%s: %s, retrying in %s\n", key, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	if err != nil {
+		return
+	}
+
+	sum, err := archiveChecksum(part)
+	if err != nil {
+		return
+	}
+	switch {
+	case published.Checksum == "":
+		log.Warningf("%s does not publish a checksum for %s\n", source.URL, key)
+	case published.Checksum != sum:
+		os.Remove(part)
+		err = &seedChecksumError{Key: key, Source: source.URL, Expected: published.Checksum, Got: sum}
+		return
+	}
+	if err = checkPins(key, sum); err != nil {
+		os.Remove(part)
+		return
+	}
+	if err = writeFileAtomic(checksumPath(zipPath), []byte(sum+"\n")); err != nil {
+		return
+	}
+	os.Remove(signaturePath(zipPath))
+	if published.Signature != "" {
+		err = writeFileAtomic(signaturePath(zipPath), []byte(published.Signature+"\n"))
+		if err != nil {
+			return
+		}
+	}
+	err = os.Rename(part, zipPath)
+	return
+}
+
+// downloadPart appends the rest of the archive to part, starting over
+// when the index does not resume.
+func downloadPart(source seedClient, org, name, version, part string) (info seedArchiveInfo, err error) {
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+
+	body, info, err := source.Archive(org, name, version, offset)
+	if e, ok := err.(*seedStatusError); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the part is not a prefix of the archive anymore
+		offset = 0
+		body, info, err = source.Archive(org, name, version, 0)
+	}
+	if err != nil {
+		return
+	}
+	defer body.Close()
+
+	if info.Offset != offset {
+		log.Debugf("%s: cannot resume, downloading again\n", seedKey(org, name, version))
+	}
+	if err = f.Truncate(info.Offset); err != nil {
+		return
+	}
+	if _, err = f.Seek(info.Offset, io.SeekStart); err != nil {
+		return
+	}
+
+	progress := newProgress(seedKey(org, name, version), info.Offset, info.Size)
+	_, err = io.Copy(io.MultiWriter(f, progress), body)
+	progress.done(err)
+	if err != nil {
+		return
+	}
+	if info.Size >= 0 {
+		if pos, _ := f.Seek(0, io.SeekCurrent); pos != info.Size {
+			err = fmt.Errorf("%s: short download, %d of %d bytes", seedKey(org, name, version), pos, info.Size)
+		}
+	}
+	return
+}
+
+// seedProgress prints how much of a download is done on the terminal,
+// nothing is printed when stderr is not one. Downloads run in parallel
+// (--jobs) but share one line: the first one printing owns it until it is
+// done, the others stay quiet meanwhile.
+type seedProgress struct {
+	Name  string
+	Done  int64
+	Total int64
+	tty   bool
+	last  time.Time
+}
+
+var (
+	progressMu    sync.Mutex
+	progressOwner *seedProgress
+)
+
+func newProgress(name string, done, total int64) *seedProgress {
+	p := &seedProgress{Name: name, Done: done, Total: total}
+	if info, err := os.Stderr.Stat(); err == nil {
+		p.tty = info.Mode()&os.ModeCharDevice != 0
+	}
+	return p
+}
+
+func (p *seedProgress) Write(b []byte) (int, error) {
+	p.Done += int64(len(b))
+	if p.tty && time.Since(p.last) > 200*time.Millisecond {
+		p.last = time.Now()
+		progressMu.Lock()
+		if progressOwner == nil {
+			progressOwner = p
+		}
+		if progressOwner == p {
+			p.print()
+		}
+		progressMu.Unlock()
+	}
+	return len(b), nil
+}
+
+func (p *seedProgress) print() {
+	if p.Total > 0 {
+		fmt.Fprintf(os.Stderr, "\rget: %s %3d%% %s/%s", p.Name, p.Done*100/p.Total, byteSize(p.Done), byteSize(p.Total))
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\rget: %s %s", p.Name, byteSize(p.Done))
+}
+
+func (p *seedProgress) done(err error) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if progressOwner != p {
+		return
+	}
+	progressOwner = nil
+	p.print()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, " failed")
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+// byteSize formats n bytes for humans.
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
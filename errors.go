@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Stages of the install pipeline reported on failures.
+const (
+	stageResolve  = "resolve"
+	stageFetch    = "fetch"
+	stageCheckout = "checkout"
+	stageList     = "list"
+	stageCopy     = "copy"
+	stageVerify   = "verify"
+)
+
+// seedError is the failure of one package on one stage of get/install.
+type seedError struct {
+	Package string
+	Stage   string
+	Err     error
+}
+
+func (e *seedError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.Package, e.Stage, e.Err)
+}
+
+// stageError tags err with the package and stage it happened on, an error
+// already tagged keeps its innermost stage.
+func stageError(pkg, stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*seedError); ok {
+		return err
+	}
+	return &seedError{Package: pkg, Stage: stage, Err: err}
+}
+
+// seedErrors collects every failure of a run, its message is the summary
+// of broken packages.
+type seedErrors []*seedError
+
+func (errs seedErrors) Error() string {
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Package < errs[j].Package
+	})
+	lines := []string{fmt.Sprintf("%d package(s) failed:", len(errs))}
+	for _, e := range errs {
+		lines = append(lines, fmt.Sprintf("    %s (%s): %s", e.Package, e.Stage, e.Err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add appends err tagged with pkg and stage, nil is ignored.
+func (errs *seedErrors) add(pkg, stage string, err error) {
+	if err == nil {
+		return
+	}
+	if all, ok := err.(seedErrors); ok {
+		*errs = append(*errs, all...)
+		return
+	}
+	*errs = append(*errs, stageError(pkg, stage, err).(*seedError))
+}
+
+// err returns errs as an error, nil when nothing failed.
+func (errs seedErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+var (
+	// DefaultInclude and DefaultExclude are used when a Seedfile does not
+	// set include or exclude. They keep what the go tool needs to build the
+	// package on any platform: Go, cgo, assembly and SWIG sources, syso
+	// objects, module and license files, plus the docs. Tests and testdata
+	// are excluded unless kept with withTests.
+	DefaultInclude = []string{
+		"**/*.go",
+		"**/*.s", "**/*.S", "**/*.sx",
+		"**/*.c", "**/*.cc", "**/*.cpp", "**/*.cxx",
+		"**/*.h", "**/*.hh", "**/*.hpp", "**/*.hxx",
+		"**/*.m", "**/*.f", "**/*.F", "**/*.for", "**/*.f90",
+		"**/*.syso", "**/*.swig", "**/*.swigcxx",
+		"**/*.proto",
+		"**/go.mod", "**/go.sum",
+		"**/LICENSE*", "**/LICENCE*", "**/COPYING*", "**/NOTICE*", "**/PATENTS*", "**/AUTHORS*",
+		"**/*.md",
+		"**/*.rst",
+		"**/testdata/**",
+	}
+	DefaultExclude = []string{
+		"**/.git",
+		"**/.github",
+		"**/vendor",
+		"**/*_test.go",
+		"**/testdata",
+	}
+
+	// testPatterns are dropped from the exclude list when tests are kept.
+	testPatterns = map[string]bool{
+		"**/*_test.go": true,
+		"**/testdata":  true,
+	}
+)
+
+// seedFilter selects the files copied to a package. Patterns are slash
+// separated, relative to the package folder, and "**" matches any number
+// of folders. A folder matching Exclude is skipped with all its content.
+// Files embedded with //go:embed are kept unless excluded.
+type seedFilter struct {
+	Include []string
+	Exclude []string
+	embed   []string
+}
+
+// packageFilter is the filter of a Seedfile [package], falling back to the
+// defaults for the lists it leaves empty.
+func packageFilter(p seedPackage) (f seedFilter) {
+	f = seedFilter{Include: p.Include, Exclude: p.Exclude}
+	if len(f.Include) == 0 {
+		f.Include = DefaultInclude
+	}
+	if len(f.Exclude) == 0 {
+		f.Exclude = DefaultExclude
+	}
+	return
+}
+
+// dirFilter is the filter of the Seedfile found in dir, the defaults when
+// there is none.
+func dirFilter(dir string) seedFilter {
+	var config SeedConfig
+	if b, err := ioutil.ReadFile(path.Join(dir, "Seedfile")); err == nil {
+		_, _ = toml.Decode(string(b), &config)
+	}
+	return packageFilter(config.Package)
+}
+
+// withTests keeps the test files and testdata folders the default exclude
+// list skips.
+func (f seedFilter) withTests() seedFilter {
+	var exclude []string
+	for _, p := range f.Exclude {
+		if !testPatterns[p] {
+			exclude = append(exclude, p)
+		}
+	}
+	f.Exclude = exclude
+	return f
+}
+
+// keep reports whether rel, a slash separated path relative to the package
+// folder, is copied. The Seedfile is always kept as the resolver needs it.
+func (f seedFilter) keep(rel string, dir bool) bool {
+	if path.Base(rel) == ".git" {
+		return false
+	}
+	for _, p := range f.Exclude {
+		if matchGlob(p, rel) {
+			return false
+		}
+	}
+	if dir || rel == "Seedfile" {
+		return true
+	}
+	for _, e := range f.embed {
+		if rel == e || strings.HasPrefix(rel, e+"/") {
+			return true
+		}
+	}
+	for _, p := range f.Include {
+		if matchGlob(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// embedFiles lists the files and folders below dir, relative to it, that
+// the kept Go files of f embed with //go:embed.
+func (f seedFilter) embedFiles(dir string) (embed []string, err error) {
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !f.keep(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !strings.HasSuffix(rel, ".go") {
+			return nil
+		}
+		patterns, err := embedPatterns(p)
+		if err != nil {
+			return err
+		}
+		for _, pattern := range patterns {
+			pattern = strings.TrimPrefix(pattern, "all:")
+			matches, _ := filepath.Glob(filepath.Join(filepath.Dir(p), filepath.FromSlash(pattern)))
+			for _, m := range matches {
+				if m, err := filepath.Rel(dir, m); err == nil {
+					embed = append(embed, filepath.ToSlash(m))
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// embedPatterns reads the patterns of the //go:embed directives of a Go
+// file, quoted patterns included.
+func embedPatterns(file string) (patterns []string, err error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "//go:embed ") {
+			continue
+		}
+		args := strings.TrimSpace(strings.TrimPrefix(line, "//go:embed "))
+		for args != "" {
+			var arg string
+			switch args[0] {
+			case '"', '`':
+				end := strings.IndexByte(args[1:], args[0])
+				if end < 0 {
+					args = ""
+					continue
+				}
+				arg, _ = strconv.Unquote(args[:end+2])
+				args = args[end+2:]
+			default:
+				end := strings.IndexAny(args, " \t")
+				if end < 0 {
+					end = len(args)
+				}
+				arg, args = args[:end], args[end:]
+			}
+			if arg != "" {
+				patterns = append(patterns, arg)
+			}
+			args = strings.TrimSpace(args)
+		}
+	}
+	return
+}
+
+// matchGlob reports whether name matches pattern, "**" matches zero or
+// more path elements and every other element is matched with path.Match.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
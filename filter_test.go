@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		// ** at the start
+		{"**/*.go", "a.go", true},
+		{"**/*.go", "x/y/a.go", true},
+		{"**/*.go", "a.txt", false},
+		{"**/vendor", "vendor", true},
+		{"**/vendor", "x/vendor", true},
+		{"**/vendor", "x/vendor/y", false},
+		// ** in the middle
+		{"cmd/**/*.go", "cmd/a.go", true},
+		{"cmd/**/*.go", "cmd/x/y/a.go", true},
+		{"cmd/**/*.go", "pkg/a.go", false},
+		{"**/testdata/**", "testdata", true},
+		{"**/testdata/**", "a/testdata/x.json", true},
+		{"**/testdata/**", "a/testdata2/x.json", false},
+		// ** at the end
+		{"docs/**", "docs", true},
+		{"docs/**", "docs/a/b.md", true},
+		{"docs/**", "doc/a.md", false},
+		{"**", "a/b/c", true},
+		// single elements
+		{"*.go", "a.go", true},
+		{"*.go", "a/b.go", false},
+		{"a/*/c", "a/b/c", true},
+		{"a/*/c", "a/b/x/c", false},
+		{"LICENSE*", "LICENSE.txt", true},
+		{"[", "[", false},
+	}
+	for _, tt := range tests {
+		if match := matchGlob(tt.pattern, tt.name); match != tt.match {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, match, tt.match)
+		}
+	}
+}
+
+func TestFilterKeep(t *testing.T) {
+	defaults := packageFilter(seedPackage{})
+	custom := packageFilter(seedPackage{
+		Include: []string{"**/*.go", "static/**"},
+		Exclude: []string{"assets", "packageX/**/*.go", "**/*_test.go"},
+	})
+	embed := defaults
+	embed.embed = []string{"web", "schema.json"}
+
+	tests := []struct {
+		desc   string
+		filter seedFilter
+		rel    string
+		dir    bool
+		keep   bool
+		tests  bool // keep with withTests
+	}{
+		{"go file", defaults, "a.go", false, true, true},
+		{"nested go file", defaults, "x/y/a.go", false, true, true},
+		{"cgo and assembly", defaults, "x/a.c", false, true, true},
+		{"license", defaults, "LICENSE", false, true, true},
+		{"docs", defaults, "README.md", false, true, true},
+		{"Seedfile", defaults, "Seedfile", false, true, true},
+		{"other file", defaults, "Makefile", false, false, false},
+		{"image", defaults, "x/logo.png", false, false, false},
+		{"folder", defaults, "x", true, true, true},
+		{"test file", defaults, "x/a_test.go", false, false, true},
+		{"testdata folder", defaults, "x/testdata", true, false, true},
+		{"testdata file", defaults, "x/testdata/in.json", false, true, true},
+		{"vendor folder", defaults, "x/vendor", true, false, false},
+		{"git folder", defaults, ".git", true, false, false},
+		{"nested git folder", defaults, "x/.git", true, false, false},
+		{"github folder", defaults, ".github", true, false, false},
+		{"embedded folder", embed, "web/index.html", false, true, true},
+		{"embedded file", embed, "schema.json", false, true, true},
+		{"not embedded", embed, "webx/index.html", false, false, false},
+		{"excluded folder", custom, "assets", true, false, false},
+		{"excluded glob", custom, "packageX/a/b.go", false, false, false},
+		{"excluded glob at the top", custom, "packageX/a.go", false, false, false},
+		{"included folder", custom, "static/css/a.css", false, true, true},
+		{"not included", custom, "README.md", false, false, false},
+		{"custom test file", custom, "a_test.go", false, false, true},
+	}
+	for _, tt := range tests {
+		if keep := tt.filter.keep(tt.rel, tt.dir); keep != tt.keep {
+			t.Errorf("%s: keep(%q) = %v, want %v", tt.desc, tt.rel, keep, tt.keep)
+		}
+		if keep := tt.filter.withTests().keep(tt.rel, tt.dir); keep != tt.tests {
+			t.Errorf("%s: withTests().keep(%q) = %v, want %v", tt.desc, tt.rel, keep, tt.tests)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Git repositories are never touched on GOPATH: each one is kept as a bare
+// mirror under <cache>/git and every revision used is exported to its own
+// read only tree under <cache>/src/<repo>@<commit>.
+
+var (
+	goImportMeta = regexp.MustCompile(`<meta\s+name="go-import"\s+content="([^"]+)"`)
+
+	gitMu      sync.Mutex
+	gitLocks   = map[string]*sync.Mutex{}
+	gitUpdated = map[string]bool{}
+	gitRemotes = map[string]gitRemote{}
+	gitUnknown = map[string]error{}
+)
+
+// gitRemote is where the repository of an import path lives.
+type gitRemote struct {
+	Root string
+	URL  string
+}
+
+// discoverRepo finds the repository of importPath: well known hosts by
+// their path, others through the go-import meta tag as `go get` does.
+func discoverRepo(importPath string) (remote gitRemote, err error) {
+	names := strings.Split(importPath, "/")
+	switch names[0] {
+	case "github.com", "bitbucket.org", "gitlab.com":
+		if len(names) < 3 {
+			err = fmt.Errorf("invalid import path: %s", importPath)
+			return
+		}
+		remote.Root = strings.Join(names[:3], "/")
+		remote.URL = fmt.Sprintf("https://%s", remote.Root)
+		return
+	}
+	if SeedOffline {
+		return offlineRemote(importPath)
+	}
+
+	gitMu.Lock()
+	for root, r := range gitRemotes {
+		if importPath == root || strings.HasPrefix(importPath, root+"/") {
+			gitMu.Unlock()
+			return r, nil
+		}
+	}
+	err, unknown := gitUnknown[importPath]
+	gitMu.Unlock()
+	if unknown {
+		return
+	}
+	defer func() {
+		if err != nil {
+			gitMu.Lock()
+			gitUnknown[importPath] = err
+			gitMu.Unlock()
+		}
+	}()
+
+	resp, err := seedHTTPClient.Get(fmt.Sprintf("https://%s?go-get=1", importPath))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return
+	}
+	for _, m := range goImportMeta.FindAllStringSubmatch(string(body), -1) {
+		f := strings.Fields(m[1])
+		if len(f) != 3 || f[1] != "git" {
+			continue
+		}
+		if importPath == f[0] || strings.HasPrefix(importPath, f[0]+"/") {
+			remote = gitRemote{Root: f[0], URL: f[2]}
+			gitMu.Lock()
+			gitRemotes[remote.Root] = remote
+			gitMu.Unlock()
+			return
+		}
+	}
+	err = fmt.Errorf("%s: no git repository found", importPath)
+	return
+}
+
+// repoRoot is the repository (or module, fetching from a proxy) holding
+// an import path, every package of a repository shares its version.
+func repoRoot(importPath string) string {
+	if SeedProxy != "" && !isSeedPackage(importPath) {
+		if modPath, err := proxyModulePath(importPath); err == nil {
+			return modPath
+		}
+	}
+	names := strings.Split(importPath, "/")
+	if names[0] == "gopkg.in" && len(names) > 1 && strings.Contains(names[1], ".v") {
+		return strings.Join(names[:2], "/")
+	}
+	if !isSeedPackage(importPath) {
+		if remote, err := discoverRepo(importPath); err == nil {
+			return remote.Root
+		}
+	}
+	if len(names) <= 3 {
+		return importPath
+	}
+	return strings.Join(names[:3], "/")
+}
+
+func lockRepo(root string) (unlock func()) {
+	gitMu.Lock()
+	l, ok := gitLocks[root]
+	if !ok {
+		l = &sync.Mutex{}
+		gitLocks[root] = l
+	}
+	gitMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func git(dir string, args ...string) (out string, err error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	if e, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(string(e.Stderr)))
+	}
+	out = strings.TrimSpace(string(b))
+	return
+}
+
+// gitMirror clones (or updates, once per run) the bare mirror of the
+// repository holding repo and returns its folder with the repository root.
+// Offline the mirror is used as it is.
+func gitMirror(repo string) (mirror, root string, err error) {
+	remote, err := discoverRepo(repo)
+	if err != nil {
+		return
+	}
+	root = remote.Root
+	mirror = filepath.Join(SeedCachePath, "git", fmt.Sprintf("%s.git", root))
+
+	unlock := lockRepo(root)
+	defer unlock()
+
+	gitMu.Lock()
+	updated := gitUpdated[root]
+	gitMu.Unlock()
+	if updated {
+		return
+	}
+
+	_, err = os.Stat(mirror)
+	switch {
+	case SeedOffline && os.IsNotExist(err):
+		err = &seedOfflineError{What: root}
+	case SeedOffline:
+		// used as it is, without fetching
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(filepath.Dir(mirror), os.ModePerm); err != nil {
+			return
+		}
+		_, err = git("", "clone", "--mirror", remote.URL, mirror)
+	case err == nil:
+		_, err = git(mirror, "remote", "update", "--prune")
+	}
+	if err != nil {
+		return
+	}
+
+	touchCache(mirror)
+	gitMu.Lock()
+	gitUpdated[root] = true
+	gitMu.Unlock()
+	return
+}
+
+// checkoutRepo exports repo at branch (or tag, or commit) from its mirror
+// and returns the folder of repo inside the export with the commit.
+// "master" falls back to the default branch of the repository.
+func checkoutRepo(repo, branch string) (repoFolder, revision string, err error) {
+	mirror, root, err := gitMirror(repo)
+	if err != nil {
+		err = stageError(repo, stageFetch, err)
+		return
+	}
+	revision, err = git(mirror, "rev-parse", "--verify", fmt.Sprintf("%s^{commit}", branch))
+	if err != nil && branch == "master" {
+		revision, err = git(mirror, "rev-parse", "--verify", "HEAD^{commit}")
+	}
+	if err != nil {
+		err = stageError(repo, stageCheckout, fmt.Errorf("unknown revision %s", branch))
+		return
+	}
+
+	export := filepath.Join(SeedCachePath, "src", fmt.Sprintf("%s@%s", root, revision))
+	repoFolder = filepath.Join(export, strings.TrimPrefix(repo, root))
+
+	unlock := lockRepo(root)
+	defer unlock()
+	if _, err = os.Stat(export); err == nil {
+		touchCache(export)
+		return
+	}
+	err = stageError(repo, stageCheckout, exportRevision(mirror, revision, export))
+	return
+}
+
+// exportRevision writes the tree of revision to dst, going through a
+// temporary folder so dst only exists once complete.
+func exportRevision(mirror, revision, dst string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), ".export-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	cmd := exec.Command("git", "archive", "--format=tar", revision)
+	cmd.Dir = mirror
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	err = untar(out, tmp)
+	if e := cmd.Wait(); err == nil && e != nil {
+		err = fmt.Errorf("git archive %s: %s", revision, e)
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp, dst)
+	return
+}
+
+func untar(r io.Reader, dst string) (err error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, e := tr.Next()
+		if e == io.EOF {
+			return
+		}
+		if e != nil {
+			return e
+		}
+		path, e := archivePath(dst, hdr.Name)
+		if e != nil {
+			return e
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, os.ModePerm)
+		case tar.TypeReg:
+			err = writeTarFile(tr, path, os.FileMode(hdr.Mode).Perm())
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeTarFile(r io.Reader, path string, mode os.FileMode) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return
+	}
+	err = f.Close()
+	return
+}
+
+// gitTags lists the tags of repo from its mirror.
+func gitTags(repo string) (tags []string, err error) {
+	mirror, _, err := gitMirror(repo)
+	if err != nil {
+		err = stageError(repo, stageFetch, err)
+		return
+	}
+	out, err := git(mirror, "tag", "--list")
+	if err != nil {
+		return
+	}
+	tags = strings.Fields(out)
+	return
+}
+
+// dirImports lists the remote imports of the package in dir for the
+// current platform, a folder without Go files has none.
+func dirImports(dir string) (packages []string, err error) {
+	pkg, err := build.Default.ImportDir(dir, build.IgnoreVendor)
+	if _, ok := err.(*build.NoGoError); ok {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	packages = externalImports(pkg.Imports)
+	return
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nuveo/log"
+)
+
+// seedInstall carries the state of one get/install run, Lock records
+// every package copied to Folder. Up to Jobs packages are fetched at the
+// same time, Tests keeps their test files.
+type seedInstall struct {
+	Folder string
+	Jobs   int
+	Tests  bool
+	Lock   seedLock
+	mu     sync.Mutex
+}
+
+// parallel calls fn for every index below n on at most jobs goroutines
+// and returns the error of each call by index.
+func parallel(n, jobs int, fn func(i int) error) (errs []error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	errs = make([]error, n)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return
+}
+
+// parallelNested is parallel for the packages names: a package nested
+// in the folder of another one (a module inside a module) is only started
+// once the packages it is nested in are done.
+func parallelNested(names []string, jobs int, fn func(i int) error) (errs []error) {
+	errs = make([]error, len(names))
+	var levels [][]int
+	for i, name := range names {
+		depth := 0
+		for _, other := range names {
+			if strings.HasPrefix(name, other+"/") {
+				depth++
+			}
+		}
+		for len(levels) <= depth {
+			levels = append(levels, nil)
+		}
+		levels[depth] = append(levels[depth], i)
+	}
+	for _, level := range levels {
+		level := level
+		for i, e := range parallel(len(level), jobs, func(i int) error { return fn(level[i]) }) {
+			errs[level[i]] = e
+		}
+	}
+	return
+}
+
+func (s *seedInstall) record(p seedLockPackage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Lock.add(p)
+}
+
+// get copies a single package and records it on the lock, a version
+// constraint is resolved to the highest matching version first.
+func (s *seedInstall) get(repo, branch string, level int) (err error) {
+	version, err := resolveVersion(repo, branch)
+	if err != nil {
+		err = stageError(repo, stageResolve, err)
+		return
+	}
+	if version != branch {
+		log.Printf("resolve: %s@%s => %s\n", repo, branch, version)
+		branch = version
+	}
+
+	var p seedLockPackage
+	var dst string
+	switch {
+	case isSeedPackage(repo):
+		dst, p.Version, err = getBySeed(repo, branch, s.Folder)
+	case SeedProxy != "":
+		dst, p.Version, p.Sum, err = getByProxy(repo, branch, "", s.Folder, s.Tests)
+	default:
+		p.Version = branch
+		dst, p.Revision, err = getRepo(repo, branch, s.Folder, level, s.Tests)
+	}
+	if err != nil {
+		return
+	}
+
+	p.Name = repo
+	p.Checksum, err = dirChecksum(dst)
+	if err != nil {
+		err = stageError(repo, stageVerify, err)
+		return
+	}
+	s.record(p)
+	return
+}
+
+// resolveVersion picks the highest version of repo matching constraint,
+// from its git tags or from the versions published on the seed sources.
+// A constraint without operator is returned as is.
+func resolveVersion(repo, constraint string) (version string, err error) {
+	c, ok := parseConstraint(constraint)
+	if !ok {
+		version = constraint
+		return
+	}
+
+	versions, err := availableVersions(repo)
+	if err != nil {
+		return
+	}
+	version, ok = c.highest(versions)
+	if !ok {
+		err = fmt.Errorf("%s: no version matches %s", repo, constraint)
+	}
+	return
+}
+
+// install resolves dependencies and copies every resolved package once,
+// at the version picked by the resolver. A failing package does not stop
+// the others, every failure is returned as seedErrors.
+func (s *seedInstall) install(dependencies []string) (err error) {
+	packages, err := newResolver(s.Jobs).resolve(dependencies)
+	failed, ok := err.(seedErrors)
+	if err != nil && (!ok || SeedOffline) {
+		// offline a failure is a missing package, nothing is copied
+		return
+	}
+	names := make([]string, len(packages))
+	for i, p := range packages {
+		names[i] = p.Name
+	}
+	errs := parallelNested(names, s.Jobs, func(i int) error {
+		p := packages[i]
+		return s.get(p.Name, p.Version, len(p.Chain))
+	})
+	for i, e := range errs {
+		failed.add(packages[i].Name, stageCopy, e)
+	}
+	err = failed.err()
+	return
+}
+
+// fromLock installs exactly the packages pinned on lock, checking that
+// the copied files match the recorded checksums.
+func (s *seedInstall) fromLock(lock seedLock) (err error) {
+	names := make([]string, len(lock.Package))
+	for i, p := range lock.Package {
+		names[i] = p.Name
+	}
+	errs := parallelNested(names, s.Jobs, func(i int) (err error) {
+		p := lock.Package[i]
+		var dst string
+		switch {
+		case p.Revision != "":
+			dst, _, err = getRepo(p.Name, p.Revision, s.Folder, 1, s.Tests)
+		case p.Sum != "":
+			dst, _, _, err = getByProxy(p.Name, p.Version, p.Sum, s.Folder, s.Tests)
+		default:
+			dst, _, err = getBySeed(p.Name, p.Version, s.Folder)
+		}
+		if err != nil {
+			return
+		}
+
+		sum, err := dirChecksum(dst)
+		if err != nil {
+			return
+		}
+		if sum != p.Checksum {
+			err = fmt.Errorf("checksum mismatch, %s locked %s got %s", SeedLockFile, p.Checksum, sum)
+			return
+		}
+		log.Debugf("%s@%s verified\n", p.Name, p.Version)
+		s.record(p)
+		return
+	})
+	var failed seedErrors
+	for i, e := range errs {
+		failed.add(lock.Package[i].Name, stageVerify, e)
+	}
+	err = failed.err()
+	return
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestParallelNested(t *testing.T) {
+	names := []string{
+		"example.com/a/b/c",
+		"example.com/a/b",
+		"example.com/ab",
+		"example.com/a",
+		"example.com/z",
+	}
+	// a package must start after every package it is nested in is done
+	after := map[string][]string{
+		"example.com/a/b/c": {"example.com/a/b", "example.com/a"},
+		"example.com/a/b":   {"example.com/a"},
+	}
+	var mu sync.Mutex
+	done := map[string]bool{}
+	errs := parallelNested(names, 8, func(i int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, parent := range after[names[i]] {
+			if !done[parent] {
+				return fmt.Errorf("%s started before %s was done", names[i], parent)
+			}
+		}
+		done[names[i]] = true
+		return nil
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+		if !done[names[i]] {
+			t.Errorf("%s not run", names[i])
+		}
+	}
+}
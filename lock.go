@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+const SeedLockFile = "Seedfile.lock"
+
+// seedLock is the content of Seedfile.lock. Dependencies is the Seedfile
+// list it was resolved from, a lock made for other dependencies is stale.
+// Tests tells whether test files were copied, checksums depend on it.
+type seedLock struct {
+	Dependencies []string          `toml:"dependencies"`
+	Tests        bool              `toml:"tests,omitempty"`
+	Package      []seedLockPackage `toml:"package"`
+}
+
+// seedLockPackage pins one installed package. Seed packages are pinned by
+// Version, git packages by the commit in Revision and packages fetched
+// from a module proxy by Version and Sum, the h1: hash of the module zip.
+// Checksum covers the files copied to the seed folder. Module is its
+// module path when the project is a Go module.
+type seedLockPackage struct {
+	Name     string `toml:"name"`
+	Version  string `toml:"version"`
+	Revision string `toml:"revision,omitempty"`
+	Sum      string `toml:"sum,omitempty"`
+	Checksum string `toml:"checksum"`
+	Module   string `toml:"module,omitempty"`
+}
+
+func readLock(path string) (lock seedLock, err error) {
+	_, err = toml.DecodeFile(path, &lock)
+	return
+}
+
+func (l seedLock) write(path string) (err error) {
+	sort.Slice(l.Package, func(i, j int) bool {
+		return l.Package[i].Name < l.Package[j].Name
+	})
+	var buf bytes.Buffer
+	buf.WriteString("# This file is generated by seed install, do not edit.\n\n")
+	if err = toml.NewEncoder(&buf).Encode(l); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	return
+}
+
+// matches reports whether the lock was resolved from dependencies, with
+// test files copied or not.
+func (l seedLock) matches(dependencies []string, tests bool) bool {
+	if l.Tests != tests || len(l.Dependencies) != len(dependencies) {
+		return false
+	}
+	for i, d := range dependencies {
+		if l.Dependencies[i] != d {
+			return false
+		}
+	}
+	return true
+}
+
+// add records p, replacing an older entry of the same package.
+func (l *seedLock) add(p seedLockPackage) {
+	for i, old := range l.Package {
+		if old.Name == p.Name {
+			l.Package[i] = p
+			return
+		}
+	}
+	l.Package = append(l.Package, p)
+}
+
+// dirChecksum hashes every file below dir with its relative path, the
+// result only depends on the file names and contents. Folders of nested
+// modules (holding a go.mod) are packages of their own and left out.
+func dirChecksum(dir string) (sum string, err error) {
+	var files []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && path != dir {
+			if _, e := os.Stat(filepath.Join(path, goModFile)); e == nil {
+				return filepath.SkipDir
+			}
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+
+	h := sha256.New()
+	for _, f := range files {
+		rel, err := filepath.Rel(dir, f)
+		if err != nil {
+			return "", err
+		}
+		fh, err := fileSHA256(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s  %s\n", fh, filepath.ToSlash(rel))
+	}
+	sum = fmt.Sprintf("sha256:%x", h.Sum(nil))
+	return
+}
+
+func fileSHA256(path string) (sum string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	sum = fmt.Sprintf("%x", h.Sum(nil))
+	return
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirChecksumNestedModule(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "seed-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "a")
+	writeTestTree(t, dir, map[string]string{
+		"go.mod":   "module example.com/a",
+		"a.go":     "package a",
+		"x/x.go":   "package x",
+		"b/go.mod": "module example.com/a/b",
+	})
+	want, err := dirChecksum(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		changes bool
+	}{
+		{"nested module file", "b/b.go", false},
+		{"nested module package", "b/c/c.go", false},
+		{"own file", "y.go", true},
+		{"own package", "x/y.go", true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, filepath.FromSlash(tt.file))
+		writeTestTree(t, dir, map[string]string{tt.file: "package z"})
+		got, err := dirChecksum(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got != want) != tt.changes {
+			t.Errorf("%s: checksum changed = %v, want %v", tt.name, got != want, tt.changes)
+		}
+		os.Remove(path)
+	}
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"text/tabwriter"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/mholt/archiver"
 	"github.com/nuveo/log"
 	"github.com/urfave/cli"
@@ -25,17 +27,15 @@ var (
 
 	SeedTempPath = fmt.Sprintf("%s/tmp", SeedPath)
 	GetMsgLog    = "get: %s@%s"
-	ExtInclude   = []string{
-		".go",
-		".md",
-		".rst",
-		"Seedfile",
-	}
+	DefaultIndex = "https://packages.goseed.io/"
 )
 
 type SeedConfig struct {
+	Seed    seedSettings
+	Source  map[string]seedSource
 	Package seedPackage
 	Server  seedServer
+	Trust   map[string][]string
 }
 type seedPackage struct {
 	Organization  string
@@ -57,16 +57,76 @@ type seedPackage struct {
 type seedServer struct {
 	Protocol string
 	Port     int
+	Path     string
+	Cert     string
+	Key      string
+	Tokens   []string
+}
+
+var jobsFlag = cli.IntFlag{
+	Name:  "jobs, j",
+	Value: runtime.NumCPU(),
+	Usage: "Number of packages fetched at the same time",
+}
+
+var testsFlag = cli.BoolFlag{
+	Name:  "tests",
+	Usage: "Keep test files and testdata folders",
+}
+
+var proxyFlag = cli.StringFlag{
+	Name:   "proxy",
+	Usage:  "Go module proxy to fetch packages outside goseed.io from instead of git (https:// or file://)",
+	EnvVar: "SEED_PROXY",
 }
 
-type seedAuth struct {
-	Token string
+var seedfileFlag = cli.StringFlag{
+	Name:  "file, f",
+	Value: "Seedfile",
+	Usage: "Seedfile of the package, its folder is the one pushed",
 }
 
+// packageConfig is config unless --file names another Seedfile, which is
+// then loaded and applied. It returns the folder of the package.
+func packageConfig(c *cli.Context, config SeedConfig) (pkg SeedConfig, dir string, err error) {
+	seedfile := c.String("file")
+	if seedfile == "" || seedfile == "Seedfile" {
+		return config, ".", nil
+	}
+	pkg, found, err := loadConfig(seedfile)
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("%s not found", seedfile)
+		return
+	}
+	if err = pkg.apply(); err != nil {
+		return
+	}
+	dir = filepath.Dir(seedfile)
+	return
+}
+
+var indexFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "index, i",
+		Usage:  "Seed Index Server to talk to (default: first of sources)",
+		EnvVar: "SEED_INDEX",
+	},
+	cli.StringFlag{
+		Name:   "token, t",
+		Usage:  "Auth token sent to the Seed Index Server",
+		EnvVar: "SEED_TOKEN",
+	},
+}
+
+// seedPush is the metadata of a package upload, sent along with its
+// archive. Signature is the base64 ed25519 signature of the archive when
+// the maintainer has a signing key.
 type seedPush struct {
-	File    string
-	Package seedPackage
-	Auth    seedAuth
+	Signature string `json:",omitempty"`
+	Package   seedPackage
 }
 
 func copyFile(src, dst string) (err error) {
@@ -108,10 +168,17 @@ func copyFile(src, dst string) (err error) {
 	return
 }
 
-func copyDir(src string, dst string) (err error) {
+// copyDir copies the files of src selected by filter to dst.
+func copyDir(src string, dst string, filter seedFilter) (err error) {
 	src = filepath.Clean(src)
-	dst = filepath.Clean(dst)
+	filter.embed, err = filter.embedFiles(src)
+	if err != nil {
+		return
+	}
+	return copyTree(src, filepath.Clean(dst), "", filter)
+}
 
+func copyTree(src, dst, rel string, filter seedFilter) (err error) {
 	si, err := os.Stat(src)
 	if err != nil {
 		return err
@@ -141,31 +208,17 @@ func copyDir(src string, dst string) (err error) {
 	for _, entry := range entries {
 		srcPath := filepath.Join(src, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
+		relPath := path.Join(rel, entry.Name())
 
+		if !filter.keep(relPath, entry.IsDir()) {
+			continue
+		}
 		if entry.IsDir() {
-			switch entry.Name() {
-			case
-				".git",
-				"vendor",
-				".github":
-				continue
-			}
-			err = copyDir(srcPath, dstPath)
+			err = copyTree(srcPath, dstPath, relPath, filter)
 			if err != nil {
 				return
 			}
 		} else {
-			containExt := false
-			for _, ext := range ExtInclude {
-				// not exist .go on file name continue
-				if strings.Contains(entry.Name(), ext) {
-					containExt = true
-				}
-			}
-			if !containExt {
-				continue
-			}
-
 			// Skip symlinks.
 			if entry.Mode()&os.ModeSymlink != 0 {
 				continue
@@ -180,18 +233,29 @@ func copyDir(src string, dst string) (err error) {
 	return
 }
 
-func getBySeed(repo, version, seedFolder string) (err error) {
+// getBySeed extracts a seed package into seedFolder and returns the
+// folder it was extracted to with the version installed.
+func getBySeed(repo, version, seedFolder string) (dst, resolved string, err error) {
 	names := strings.Split(repo, "/")
-	PackageName := fmt.Sprintf("%s-%s-%s", names[1], names[2], version)
+	if len(names) < 3 {
+		err = fmt.Errorf("invalid seed package: %s", repo)
+		return
+	}
 
 	fmt.Println("get: ", repo, " branch/commit: ", version)
 
-	zipPath := fmt.Sprintf("%s/%s.zip", SeedCachePath, PackageName)
-	repoFolder := fmt.Sprintf("%s/src/%s/%s", os.Getenv("GOPATH"), names[0], names[1])
-	if seedFolder == "vendor" {
-		projectFolder, _ := os.Getwd()
-		repoFolder = fmt.Sprintf("%s/vendor/%s/%s", projectFolder, names[0], names[1])
+	zipPath, resolved, err := fetchSeed(names[1], names[2], version)
+	switch err.(type) {
+	case *seedChecksumError, *seedSignatureError:
+		err = stageError(repo, stageVerify, err)
+		return
 	}
+	if err != nil {
+		err = stageError(repo, stageFetch, err)
+		return
+	}
+	PackageName := fmt.Sprintf("%s-%s-%s", names[1], names[2], resolved)
+	repoFolder := fmt.Sprintf("%s/%s/%s", installPath(seedFolder), names[0], names[1])
 
 	_, err = os.Stat(repoFolder)
 	if err != nil {
@@ -201,18 +265,38 @@ func getBySeed(repo, version, seedFolder string) (err error) {
 		}
 	}
 
-	err = archiver.Zip.Open(zipPath, repoFolder)
+	// extract next to the destination and only move it in place once the
+	// whole archive is out
+	tmp, err := ioutil.TempDir(repoFolder, ".extract-")
+	if err != nil {
+		err = stageError(repo, stageCopy, err)
+		return
+	}
+	defer os.RemoveAll(tmp)
+
+	err = extractZip(zipPath, tmp)
 	if err != nil {
+		err = stageError(repo, stageVerify, err)
+		return
+	}
+	src := fmt.Sprintf("%s/%s", tmp, PackageName)
+	if _, err = os.Stat(src); err != nil {
+		err = stageError(repo, stageVerify, fmt.Errorf("archive has no %s folder", PackageName))
 		return
 	}
 
-	fullPath := fmt.Sprintf("%s/%s", repoFolder, names[2])
-	err = os.Rename(fmt.Sprintf("%s/%s", repoFolder, PackageName), fullPath)
+	dst = fmt.Sprintf("%s/%s", repoFolder, names[2])
+	if err = checkReplace(dst); err != nil {
+		err = stageError(repo, stageCopy, err)
+		return
+	}
+	err = stageError(repo, stageCopy, replaceDir(src, dst))
 	return
 }
 
-func getRepo(repo, branch, seedFolder string, logLevel int) (err error) {
-	ProjectFolder, _ := os.Getwd()
+// getRepo copies repo at branch (or commit) into seedFolder and returns
+// the destination folder with the commit copied.
+func getRepo(repo, branch, seedFolder string, logLevel int, tests bool) (dst, revision string, err error) {
 	msgLog := fmt.Sprintf(GetMsgLog, repo, branch)
 	if logLevel > 1 {
 		msgIdent := ""
@@ -223,64 +307,72 @@ func getRepo(repo, branch, seedFolder string, logLevel int) (err error) {
 	}
 	log.Println(msgLog)
 
-	args := []string{"get", "-u", repo}
-	_ = exec.Command("go", args...).Run()
-
-	repoFolder := fmt.Sprintf("%s/src/%s", os.Getenv("GOPATH"), repo)
-	if branch != "master" {
-		if err = os.Chdir(repoFolder); err != nil {
-			err = errors.New(fmt.Sprintf("Folder not exist!: %s", err))
-			return
-		}
-
-		err = exec.Command("git", []string{"checkout", branch}...).Run()
-		if err != nil {
-			return
-		}
+	repoFolder, revision, err := checkoutRepo(repo, branch)
+	if err != nil {
+		return
 	}
+	dst, err = copyRepo(repo, repoFolder, seedFolder, tests)
+	return
+}
 
-	SeedPath := seedFolder
+// installPath is the folder packages are copied to for seedFolder:
+// "vendor" of the project, any other folder as is.
+func installPath(seedFolder string) string {
 	if seedFolder == "vendor" {
-		SeedPath = fmt.Sprintf("%s/%s", ProjectFolder, seedFolder)
+		ProjectFolder, _ := os.Getwd()
+		return fmt.Sprintf("%s/%s", ProjectFolder, seedFolder)
 	}
+	return seedFolder
+}
+
+// checkReplace refuses to replace dst when seed did not write it: a
+// folder holding a .git is a checkout of the user.
+func checkReplace(dst string) (err error) {
+	if _, e := os.Lstat(filepath.Join(dst, ".git")); e == nil {
+		err = fmt.Errorf("%s is a git checkout, not replacing it", dst)
+	}
+	return
+}
+
+// copyRepo copies the tree of repo fetched on repoFolder into seedFolder
+// and returns the destination folder.
+func copyRepo(repo, repoFolder, seedFolder string, tests bool) (dst string, err error) {
+	SeedPath := installPath(seedFolder)
 
 	// create SeedPath dir
 	err = os.MkdirAll(SeedPath, os.ModePerm)
 	if err != nil {
+		err = stageError(repo, stageCopy, err)
 		return
 	}
-	// sync folder
-	dstPath := fmt.Sprintf("%s/%s", SeedPath, repo)
-	err = copyDir(repoFolder, dstPath)
-	return
-}
-
-func recursiveRepo(repo, branch, seedFolder string, level int) (err error) {
-	if strings.Contains(repo, "goseed.io/") {
-		if branch == "master" {
-			branch = "latest"
-		}
-		err = getBySeed(repo, branch, seedFolder)
-	} else {
-		getRepo(repo, branch, seedFolder, level)
+	// sync folder: copy next to the destination and only swap it in once
+	// complete, so no file of a previous version is left behind
+	dst = fmt.Sprintf("%s/%s", SeedPath, repo)
+	if err = checkReplace(dst); err != nil {
+		err = stageError(repo, stageCopy, err)
+		return
 	}
-
-	packages, err := listDependencies(repo)
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		err = stageError(repo, stageCopy, err)
+		return
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), ".copy-")
 	if err != nil {
+		err = stageError(repo, stageCopy, err)
 		return
 	}
-	for _, p := range packages {
-		if p != "" {
-			if strings.Contains(p, "goseed.io/") {
-				if branch == "master" {
-					branch = "latest"
-				}
-				err = recursiveRepo(p, branch, seedFolder, level+1)
-			} else {
-				err = recursiveRepo(p, "master", seedFolder, level+1)
-			}
-		}
+	defer os.RemoveAll(tmp)
+
+	filter := dirFilter(repoFolder)
+	if tests {
+		filter = filter.withTests()
+	}
+	src := filepath.Join(tmp, "src")
+	if err = copyDir(repoFolder, src, filter); err != nil {
+		err = stageError(repo, stageCopy, err)
+		return
 	}
+	err = stageError(repo, stageCopy, replaceModule(src, dst))
 	return
 }
 
@@ -294,9 +386,16 @@ func listDependencies(p string) (packages []string, err error) {
 		return
 	}
 	clear := strings.Replace(string(outPut), `'`, "", -1)
-	allPackage := strings.Split(clear, "\n")
-	for _, v := range allPackage {
-		if len(strings.Split(v, "/")) >= 3 {
+	packages = externalImports(strings.Split(clear, "\n"))
+	return
+}
+
+// externalImports keeps the imports fetched from a remote repository,
+// dropping the standard library and vendored packages.
+func externalImports(imports []string) (packages []string) {
+	for _, v := range imports {
+		names := strings.Split(v, "/")
+		if len(names) >= 2 && strings.Contains(names[0], ".") {
 			if !strings.Contains(v, "vendor/") {
 				packages = append(packages, v)
 			}
@@ -311,10 +410,18 @@ func main() {
 		panic(err)
 	}
 
-	var config SeedConfig
-	if _, err = toml.DecodeFile("Seedfile", &config); err != nil {
+	config, found, err := loadConfig("Seedfile")
+	if err != nil {
+		log.Errorln(err)
+		os.Exit(1)
+	}
+	if !found {
 		log.Warningln("Seedfile not found!")
 	}
+	if err = config.apply(); err != nil {
+		log.Errorln(err)
+		os.Exit(1)
+	}
 
 	app := cli.NewApp()
 	app.Version = "0.1"
@@ -330,19 +437,117 @@ func main() {
 					Value: "vendor",
 					Usage: "Install packages list by Seedfile on seed (or vendor) folder.",
 				},
+				cli.BoolFlag{
+					Name:  "update, u",
+					Usage: "Ignore Seedfile.lock, resolve dependencies again and rewrite it",
+				},
+				jobsFlag,
+				testsFlag,
+				proxyFlag,
+				cli.BoolFlag{
+					Name:   "offline",
+					Usage:  "Install from ~/.seed/cache and file:// sources and proxies only, never touch the network",
+					EnvVar: "SEED_OFFLINE",
+				},
+				cli.StringFlag{
+					Name:  "from-bundle",
+					Usage: "Install the packages of a bundle made by `seed vendor --export`, offline",
+				},
 			},
 			Action: func(c *cli.Context) (err error) {
-				SeedFolder := c.String("folder")
+				if c.String("proxy") != "" {
+					setProxy(c.String("proxy"))
+				}
+				SeedOffline = c.Bool("offline")
+				install := &seedInstall{Folder: c.String("folder"), Jobs: c.Int("jobs"), Tests: c.Bool("tests")}
+
+				modules := moduleMode()
+				if modules && install.Folder != "vendor" {
+					log.Warningf("%s found but installing to %s, go.mod is left as is\n", goModFile, install.Folder)
+					modules = false
+				}
+
+				if path := c.String("from-bundle"); path != "" {
+					var lock seedLock
+					if lock, err = install.fromBundle(path); err != nil {
+						return
+					}
+					if modules {
+						if err = syncModules(&install.Lock, lock, lock.Dependencies); err != nil {
+							return
+						}
+					}
+					if !lock.matches(config.Package.Dependencies, lock.Tests) {
+						log.Warningf("%s was exported from other dependencies than Seedfile ones\n", path)
+					}
+					install.Lock.Dependencies = lock.Dependencies
+					install.Lock.Tests = install.Tests
+					err = install.Lock.write(SeedLockFile)
+					return
+				}
+
+				lock, err := readLock(SeedLockFile)
+				switch {
+				case err == nil && !c.Bool("update") && lock.matches(config.Package.Dependencies, install.Tests):
+					if SeedOffline {
+						if missing := lock.missing(); len(missing) > 0 {
+							err = fmt.Errorf("offline, %d package(s) missing from the cache:\n    %s", len(missing), strings.Join(missing, "\n    "))
+							return
+						}
+					}
+					err = install.fromLock(lock)
+					if err == nil && modules {
+						err = syncModules(&install.Lock, lock, config.Package.Dependencies)
+					}
+					return
+				case err == nil && !c.Bool("update"):
+					log.Warningf("%s is out of date with Seedfile dependencies, resolving again\n", SeedLockFile)
+				case err != nil && !os.IsNotExist(err):
+					return
+				}
 
-				for _, dependence := range config.Package.Dependencies {
-					repo := strings.Split(dependence, "@")
-					branch := "master"
-					if len(repo) == 2 {
-						branch = repo[1]
+				err = install.install(config.Package.Dependencies)
+				if err != nil {
+					return
+				}
+				if modules {
+					if err = syncModules(&install.Lock, lock, config.Package.Dependencies); err != nil {
+						return
 					}
+				}
 
-					err = recursiveRepo(repo[0], branch, SeedFolder, 1)
+				install.Lock.Dependencies = config.Package.Dependencies
+				install.Lock.Tests = install.Tests
+				err = install.Lock.write(SeedLockFile)
+				return
+			},
+		},
+		{
+			Name:  "vendor",
+			Usage: "Export every package of Seedfile to a bundle installable offline (install --from-bundle)",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "export, e",
+					Usage: "Bundle to write (.tar.gz, .tar or .zip)",
+				},
+				jobsFlag,
+				testsFlag,
+				proxyFlag,
+			},
+			Action: func(c *cli.Context) (err error) {
+				if c.String("export") == "" {
+					err = fmt.Errorf("set the bundle to write with --export")
+					return
+				}
+				if c.String("proxy") != "" {
+					setProxy(c.String("proxy"))
 				}
+				install := &seedInstall{Jobs: c.Int("jobs"), Tests: c.Bool("tests")}
+				manifest, err := install.exportBundle(config.Package.Dependencies, c.String("export"))
+				if err != nil {
+					return
+				}
+				log.Printf("%s: %d package(s) exported\n", c.String("export"), len(manifest.Packages))
 				return
 			},
 		},
@@ -371,26 +576,22 @@ func main() {
 			Name:    "get",
 			Aliases: []string{"g"},
 			Usage:   "Fetch from and integrate with remote repository to GOPATH or vendor (if exist folder vendor this path)",
+			Flags:   []cli.Flag{jobsFlag, testsFlag, proxyFlag},
 			Action: func(c *cli.Context) (err error) {
 				if c.NArg() == 0 {
 					fmt.Println("Pls set repository!")
 					return
 				}
-
-				seedFolder := "gopath"
-				if _, err = os.Stat("./vendor"); err == nil {
-					seedFolder = "vendor"
-				}
-
-				repo := strings.Split(c.Args().Get(0), "@")
-				branch := "master"
-				if len(repo) == 2 {
-					branch = repo[1]
+				if c.String("proxy") != "" {
+					setProxy(c.String("proxy"))
 				}
 
-				err = recursiveRepo(repo[0], branch, seedFolder, 1)
-				if err != nil {
-					return
+				// never GOPATH/src, it holds the checkouts of the user
+				install := &seedInstall{Folder: "vendor", Jobs: c.Int("jobs"), Tests: c.Bool("tests")}
+				dependencies := []string{c.Args().Get(0)}
+				err = install.install(dependencies)
+				if err == nil && moduleMode() {
+					err = syncModules(&install.Lock, seedLock{}, dependencies)
 				}
 				return
 			},
@@ -399,39 +600,306 @@ func main() {
 			Name:    "push",
 			Aliases: []string{"p"},
 			Usage:   "The distutils command upload pushes the distribution files to Seed Index Server",
+			Flags:   append([]cli.Flag{seedfileFlag, testsFlag}, indexFlags...),
 			Action: func(c *cli.Context) (err error) {
+				config, dir, err := packageConfig(c, config)
+				if err != nil {
+					return
+				}
+				if config.Package.Name == "" || config.Package.Version == "" {
+					err = errors.New("Seedfile [package] requires name and version")
+					return
+				}
 				PackageName := config.Package.PackageFullName()
 				PackagePach := fmt.Sprintf("%s/%s", SeedTempPath, PackageName)
+				defer os.RemoveAll(PackagePach)
 
-				_ = copyDir(".", PackagePach)
-				zipPath := fmt.Sprintf("%s/%s.zip", SeedCachePath, PackageName)
+				filter := packageFilter(config.Package)
+				if c.Bool("tests") {
+					filter = filter.withTests()
+				}
+				err = copyDir(dir, PackagePach, filter)
+				if err != nil {
+					return
+				}
+				// never on the cache: fetchSeed trusts the archives there and
+				// the index may refuse this one
+				zipPath := fmt.Sprintf("%s/%s.zip", SeedTempPath, PackageName)
+				defer os.Remove(zipPath)
 				err = archiver.Zip.Make(zipPath, []string{PackagePach})
 				if err != nil {
 					return
 				}
 
-				zipFile, err := os.Open(zipPath)
-				if err != nil {
+				sPush := seedPush{Package: config.Package}
+				sPush.Package.Organization = config.Package.org()
+
+				key, err := readKey(SeedKeyPath)
+				switch {
+				case os.IsNotExist(err):
+					log.Warningf("%s not found, pushing %s unsigned (create a key with seed keygen)\n", SeedKeyPath, PackageName)
+				case err != nil:
 					return
+				default:
+					sPush.Signature, err = signArchive(zipPath, key)
+					if err != nil {
+						return
+					}
 				}
-				defer zipFile.Close()
-				zipInfo, _ := zipFile.Stat()
-				zipSize := zipInfo.Size()
-				buf := make([]byte, zipSize)
-				zipReader := bufio.NewReader(zipFile)
-				zipReader.Read(buf)
-				zipBase64Str := base64.StdEncoding.EncodeToString(buf)
-				log.Println(zipBase64Str)
 
-				sPush := seedPush{
-					File: zipBase64Str,
+				client := config.indexClient(c)
+				resp, err := client.Push(sPush, zipPath)
+				if err != nil {
+					err = fmt.Errorf("push %s: %s", PackageName, err)
+					return
+				}
+				log.Println(resp.Message)
+				if sum, e := archiveChecksum(zipPath); e == nil {
+					log.Printf("pin it on dependent Seedfiles as \"goseed.io/%s/%s@%s %s\"\n",
+						sPush.Package.Organization, config.Package.Name, config.Package.Version, sum)
+				}
+				return
+			},
+		},
+		{
+			Name:    "register",
+			Aliases: []string{"r"},
+			Usage:   "The distutils command register is used to submit your distribution's meta-data to an Seed Index Server",
+			Flags:   append([]cli.Flag{seedfileFlag}, indexFlags...),
+			Action: func(c *cli.Context) (err error) {
+				config, _, err := packageConfig(c, config)
+				if err != nil {
+					return
 				}
-				fmt.Printf("%#v", sPush)
+				if config.Package.Name == "" {
+					err = errors.New("Seedfile [package] requires name")
+					return
+				}
+				reg := seedRegister{Package: config.Package}
+				reg.Package.Organization = config.Package.org()
 
-				err = os.RemoveAll(PackagePach)
+				client := config.indexClient(c)
+				resp, err := client.Register(reg)
+				if err != nil {
+					err = fmt.Errorf("register %s/%s: %s", reg.Package.Organization, reg.Package.Name, err)
+					return
+				}
+				log.Println(resp.Message)
+				return
+			},
+		},
+		{
+			Name:      "search",
+			Aliases:   []string{"s"},
+			Usage:     "Find remote Seed to an Index Server",
+			ArgsUsage: "[terms]",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print results as JSON",
+				},
+			}, indexFlags...),
+			Action: func(c *cli.Context) (err error) {
+				client := config.indexClient(c)
+				results, err := client.Search(strings.Join(c.Args(), " "))
+				if err != nil {
+					return
+				}
+				if c.Bool("json") {
+					err = json.NewEncoder(os.Stdout).Encode(results)
+					return
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				for _, r := range results {
+					fmt.Fprintf(w, "%s/%s\t%s\t%s\n", r.Organization, r.Name, r.Version, r.Description)
+				}
+				err = w.Flush()
+				return
+			},
+		},
+		{
+			Name:  "cache",
+			Usage: "Inspect and clean the seed cache (~/.seed/cache and ~/.seed/tmp)",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List cached archives, git mirrors, exported revisions and leftovers",
+					Action: func(c *cli.Context) (err error) {
+						entries, err := cacheEntries()
+						if err != nil {
+							return
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+						for _, e := range entries {
+							fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Kind, e.Name, byteSize(e.Size), e.Used.Format("2006-01-02 15:04"))
+						}
+						err = w.Flush()
+						return
+					},
+				},
+				{
+					Name:  "size",
+					Usage: "Show the disk space used by each kind of entry",
+					Action: func(c *cli.Context) (err error) {
+						entries, err := cacheEntries()
+						if err != nil {
+							return
+						}
+						var kinds []string
+						count, size := map[string]int{}, map[string]int64{}
+						var total int64
+						for _, e := range entries {
+							if count[e.Kind] == 0 {
+								kinds = append(kinds, e.Kind)
+							}
+							count[e.Kind]++
+							size[e.Kind] += e.Size
+							total += e.Size
+						}
+						w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+						for _, k := range kinds {
+							fmt.Fprintf(w, "%s\t%d\t%s\n", k, count[k], byteSize(size[k]))
+						}
+						fmt.Fprintf(w, "total\t%d\t%s\n", len(entries), byteSize(total))
+						err = w.Flush()
+						return
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "Check cached archives against their recorded checksums",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "remove",
+							Usage: "Remove the archives failing the check",
+						},
+					},
+					Action: func(c *cli.Context) (err error) {
+						entries, err := cacheEntries()
+						if err != nil {
+							return
+						}
+						var failed seedErrors
+						checked := 0
+						for _, e := range entries {
+							ok, e2 := e.verify()
+							if ok {
+								checked++
+							}
+							if e2 == nil {
+								continue
+							}
+							failed.add(e.Name, stageVerify, e2)
+							if c.Bool("remove") {
+								if e3 := e.remove(); e3 != nil {
+									log.Warningln(e3)
+								}
+							}
+						}
+						log.Printf("%d archives checked\n", checked)
+						err = failed.err()
+						return
+					},
+				},
+				{
+					Name:      "clean",
+					Usage:     "Remove cache entries: all, unused for a while or of some packages",
+					ArgsUsage: "[package...]",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "Remove everything",
+						},
+						cli.StringFlag{
+							Name:  "older-than",
+							Usage: "Remove entries not used for this long (\"30d\", \"12h\")",
+						},
+					},
+					Action: func(c *cli.Context) (err error) {
+						var age time.Duration
+						if c.String("older-than") != "" {
+							if age, err = parseAge(c.String("older-than")); err != nil {
+								return
+							}
+						}
+						if !c.Bool("all") && age == 0 && c.NArg() == 0 {
+							err = errors.New("tell what to clean: --all, --older-than or package names")
+							return
+						}
+
+						entries, err := cacheEntries()
+						if err != nil {
+							return
+						}
+						var removed int
+						var freed int64
+						for _, e := range entries {
+							if age > 0 && time.Since(e.Used) < age {
+								continue
+							}
+							if c.NArg() > 0 {
+								match := false
+								for _, pkg := range c.Args() {
+									match = match || e.matches(pkg)
+								}
+								if !match {
+									continue
+								}
+							}
+							if err = e.remove(); err != nil {
+								return
+							}
+							log.Debugf("removed %s %s\n", e.Kind, e.Name)
+							removed++
+							freed += e.Size
+						}
+						log.Printf("%d entries removed, %s freed\n", removed, byteSize(freed))
+						return
+					},
+				},
+			},
+		},
+		{
+			Name:  "keygen",
+			Usage: "Create the ed25519 key push signs packages with",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Replace an existing key",
+				},
+			},
+			Action: func(c *cli.Context) (err error) {
+				public, err := generateKey(SeedKeyPath, c.Bool("force"))
 				if err != nil {
 					return
 				}
+				log.Printf("signing key written to %s\n", SeedKeyPath)
+				fmt.Printf("[trust]\n%s = [\"%s\"]\n", config.Package.org(), public)
+				return
+			},
+		},
+		{
+			Name:  "server",
+			Usage: "Run a Seed Index Server storing pushed packages",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "port, p",
+					Usage: "Port to listen on (default: Seedfile [server] port or 8080)",
+				},
+				cli.StringFlag{
+					Name:  "path",
+					Usage: "Folder where packages are stored (default: ~/.seed/server)",
+				},
+			},
+			Action: func(c *cli.Context) (err error) {
+				server := config.Server
+				if c.IsSet("port") {
+					server.Port = c.Int("port")
+				}
+				if c.IsSet("path") {
+					server.Path = c.String("path")
+				}
+				err = runServer(server)
 				return
 			},
 		},
@@ -440,14 +908,21 @@ func main() {
 	sort.Sort(cli.FlagsByName(app.Flags))
 	sort.Sort(cli.CommandsByName(app.Commands))
 
-	app.Run(os.Args)
+	if err = app.Run(os.Args); err != nil {
+		log.Errorln(err)
+		os.Exit(1)
+	}
 }
 
-func (p seedPackage) PackageFullName() (name string) {
+func (p seedPackage) org() (name string) {
 	name = "avelino"
 	if p.Organization != "" {
 		name = p.Organization
 	}
-	name = fmt.Sprintf("%s-%s-%s", name, p.Name, p.Version)
+	return
+}
+
+func (p seedPackage) PackageFullName() (name string) {
+	name = fmt.Sprintf("%s-%s-%s", p.org(), p.Name, p.Version)
 	return
 }
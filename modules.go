@@ -0,0 +1,754 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuveo/log"
+)
+
+// In module mode (a go.mod on the project) seed vendors every package as
+// a module: go.mod requires the version copied to vendor, vendor/modules.txt
+// lists it and go.sum carries its hashes, so `go build` uses vendor as is.
+
+const (
+	goModFile     = "go.mod"
+	goSumFile     = "go.sum"
+	goModulesFile = "vendor/modules.txt"
+)
+
+// moduleMode reports whether the project in the current folder is a Go
+// module.
+func moduleMode() bool {
+	if os.Getenv("GO111MODULE") == "off" {
+		return false
+	}
+	_, err := os.Stat(goModFile)
+	return err == nil
+}
+
+// seedModFile is a go.mod, kept as lines so rewriting it only touches the
+// requirements seed manages.
+type seedModFile struct {
+	Module  string
+	Go      string
+	Require []seedModRequire
+	Replace bool
+	lines   []string
+	block   int // line closing the last require block, -1 if none
+}
+
+type seedModRequire struct {
+	Path     string
+	Version  string
+	Indirect bool
+	note     string // comment of the line besides "indirect"
+	line     int
+	inBlock  bool
+}
+
+func parseModFile(data []byte) (f seedModFile) {
+	f.lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	f.block = -1
+	block := ""
+	for i, raw := range f.lines {
+		line := raw
+		comment := ""
+		if j := strings.Index(line, "//"); j >= 0 {
+			line, comment = line[:j], strings.TrimSpace(line[j+2:])
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if block != "" {
+			if fields[0] == ")" {
+				if block == "require" {
+					f.block = i
+				}
+				block = ""
+				continue
+			}
+			fields = append([]string{block}, fields...)
+		} else if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		} else if len(fields) == 1 && strings.HasSuffix(fields[0], "(") {
+			block = strings.TrimSuffix(fields[0], "(")
+			continue
+		}
+
+		switch fields[0] {
+		case "module":
+			if len(fields) > 1 {
+				f.Module = unquoteModPath(fields[1])
+			}
+		case "go":
+			if len(fields) > 1 {
+				f.Go = fields[1]
+			}
+		case "replace":
+			f.Replace = true
+		case "require":
+			if len(fields) > 2 {
+				r := seedModRequire{
+					Path:    unquoteModPath(fields[1]),
+					Version: fields[2],
+					note:    comment,
+					line:    i,
+					inBlock: block != "",
+				}
+				if comment == "indirect" || strings.HasPrefix(comment, "indirect;") {
+					r.Indirect = true
+					r.note = strings.TrimSpace(strings.TrimPrefix(comment, "indirect"))
+					r.note = strings.TrimSpace(strings.TrimPrefix(r.note, ";"))
+				}
+				f.Require = append(f.Require, r)
+			}
+		}
+	}
+	return
+}
+
+func unquoteModPath(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
+
+func readModFile(path string) (f seedModFile, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	f = parseModFile(b)
+	return
+}
+
+func (r seedModRequire) String() string {
+	s := fmt.Sprintf("%s %s", r.Path, r.Version)
+	switch {
+	case r.Indirect && r.note != "":
+		s += " // indirect; " + r.note
+	case r.Indirect:
+		s += " // indirect"
+	case r.note != "":
+		s += " // " + r.note
+	}
+	return s
+}
+
+// setRequires updates the requirements of set (by module path) in place,
+// keeping their comments, adds the missing ones to the last require block
+// and drops those of remove. Other requirements are left untouched.
+func (f *seedModFile) setRequires(set []seedModRequire, remove map[string]bool) {
+	byPath := map[string]seedModRequire{}
+	for _, r := range set {
+		byPath[r.Path] = r
+	}
+	drop := map[int]bool{}
+	for _, old := range f.Require {
+		r, ok := byPath[old.Path]
+		switch {
+		case ok:
+			delete(byPath, old.Path)
+			r.line, r.inBlock, r.note = old.line, old.inBlock, old.note
+			if r.inBlock {
+				f.lines[r.line] = "\t" + r.String()
+			} else {
+				f.lines[r.line] = "require " + r.String()
+			}
+		case remove[old.Path]:
+			drop[old.line] = true
+		}
+	}
+
+	var added []string
+	for _, r := range set {
+		if _, ok := byPath[r.Path]; ok {
+			added = append(added, "\t"+r.String())
+		}
+	}
+	var lines []string
+	for i, line := range f.lines {
+		if i == f.block {
+			lines = append(lines, added...)
+			added = nil
+		}
+		if !drop[i] {
+			lines = append(lines, line)
+			continue
+		}
+		// a line dropped between blank lines leaves one of them
+		if n := len(lines); n > 0 && strings.TrimSpace(lines[n-1]) == "" &&
+			(i+1 == len(f.lines) || strings.TrimSpace(f.lines[i+1]) == "") {
+			lines = lines[:n-1]
+		}
+	}
+	if len(added) > 0 {
+		lines = append(lines, "", "require (")
+		lines = append(lines, added...)
+		lines = append(lines, ")")
+	}
+	// drop the require blocks left empty
+	var kept []string
+	for i := 0; i < len(lines); i++ {
+		if strings.Join(strings.Fields(lines[i]), "") == "require(" && i+1 < len(lines) && strings.TrimSpace(lines[i+1]) == ")" {
+			i++
+			if n := len(kept); n > 0 && strings.TrimSpace(kept[n-1]) == "" {
+				kept = kept[:n-1]
+			}
+			continue
+		}
+		kept = append(kept, lines[i])
+	}
+	*f = parseModFile([]byte(strings.Join(kept, "\n")))
+}
+
+func (f seedModFile) bytes() []byte {
+	return []byte(strings.Join(f.lines, "\n") + "\n")
+}
+
+// seedModule is a vendored package as the go tool knows it.
+type seedModule struct {
+	Path      string
+	Version   string
+	GoVersion string
+	Sum       string
+	ModSum    string
+	Packages  []string
+}
+
+// moduleFile is a file of a module, named as in the module zip
+// ("<path>@<version>/<name>").
+type moduleFile struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+// hashModule is the h1: hash go.sum records for the files of a module.
+func hashModule(files []moduleFile) (sum string, err error) {
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	h := sha256.New()
+	for _, f := range files {
+		if strings.Contains(f.Name, "\n") {
+			return "", fmt.Errorf("invalid file name: %q", f.Name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%x  %s\n", fh.Sum(nil), f.Name)
+	}
+	sum = fmt.Sprintf("h1:%s", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	return
+}
+
+// hashGoMod is the h1: hash of a go.mod, the "/go.mod" line of go.sum.
+func hashGoMod(data []byte) (string, error) {
+	return hashModule([]moduleFile{{Name: "go.mod", Open: func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}}})
+}
+
+// moduleExcluded follows the rules of module zips: version control
+// folders, nested modules and the packages of vendor folders are left out.
+func moduleExcluded(rel string) bool {
+	for _, elem := range strings.Split(rel, "/") {
+		switch elem {
+		case ".bzr", ".git", ".hg", ".svn":
+			return true
+		}
+	}
+	i := 0
+	if strings.HasPrefix(rel, "vendor/") {
+		i = len("vendor/")
+	} else if j := strings.Index(rel, "/vendor/"); j >= 0 {
+		// the go tool keeps this offset for compatibility of existing
+		// checksums, so does seed
+		i = len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(rel[i:], "/")
+}
+
+// dirModuleFiles lists the files of the module rooted at dir.
+func dirModuleFiles(dir, prefix string) (files []moduleFile, err error) {
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			switch info.Name() {
+			case ".bzr", ".git", ".hg", ".svn":
+				return filepath.SkipDir
+			}
+			if _, e := os.Stat(filepath.Join(p, goModFile)); e == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || moduleExcluded(rel) {
+			return nil
+		}
+		file := p
+		files = append(files, moduleFile{Name: prefix + rel, Open: func() (io.ReadCloser, error) {
+			return os.Open(file)
+		}})
+		return nil
+	})
+	return
+}
+
+// zipModuleFiles lists the files below top of a seed archive, nested
+// modules excluded.
+func zipModuleFiles(zr *zip.Reader, top, prefix string) (files []moduleFile) {
+	nested := map[string]bool{}
+	for _, f := range zr.File {
+		rel := strings.TrimPrefix(f.Name, top+"/")
+		if path.Base(rel) == goModFile && path.Dir(rel) != "." {
+			nested[path.Dir(rel)] = true
+		}
+	}
+	for _, f := range zr.File {
+		rel := strings.TrimPrefix(f.Name, top+"/")
+		if rel == f.Name || !f.Mode().IsRegular() || moduleExcluded(rel) {
+			continue
+		}
+		skip := false
+		for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+			skip = skip || nested[dir]
+		}
+		if skip {
+			continue
+		}
+		f := f
+		files = append(files, moduleFile{Name: prefix + rel, Open: f.Open})
+	}
+	return
+}
+
+// canonicalVersion turns a version into the vX.Y.Z form go.mod requires,
+// false when it is not a semantic version.
+func canonicalVersion(version string) (string, bool) {
+	v, ok := parseVersion(version)
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprintf("v%s", v), true
+}
+
+// pseudoVersion is the vN.0.0-<time>-<commit> version of a commit of the
+// module modPath, N being the major version its path carries.
+func pseudoVersion(modPath, commit string, t time.Time) string {
+	if len(commit) > 12 {
+		commit = commit[:12]
+	}
+	return fmt.Sprintf("v%d.0.0-%s-%s", pathMajor(modPath), t.UTC().Format("20060102150405"), commit)
+}
+
+// pathMajor is the major version a module path asks for: N for
+// "example.com/repo/vN" (N >= 2) and "gopkg.in/pkg.vN", 0 otherwise.
+func pathMajor(modPath string) int {
+	sep := "/v"
+	if strings.HasPrefix(modPath, "gopkg.in/") {
+		sep = ".v"
+	}
+	i := strings.LastIndex(modPath, sep)
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(modPath[i+len(sep):])
+	if err != nil || n < 0 || (sep == "/v" && n < 2) || strconv.Itoa(n) != modPath[i+len(sep):] {
+		return 0
+	}
+	return n
+}
+
+// modulePathMajor checks a version against the major suffix of a module
+// path: v2 and above need "/vN", unless the package has no go.mod.
+func modulePathMajor(modPath, version string, hasGoMod bool) (string, bool) {
+	v, _ := parseVersion(version)
+	if v.Major < 2 {
+		return version, true
+	}
+	if strings.HasSuffix(modPath, fmt.Sprintf("/v%d", v.Major)) {
+		return version, true
+	}
+	if !hasGoMod {
+		return version + "+incompatible", true
+	}
+	return "", false
+}
+
+// taggedVersion is the highest semantic version tagged on revision that
+// suits the module path.
+func taggedVersion(mirror, revision, modPath string, hasGoMod bool) (version string, ok bool) {
+	out, err := git(mirror, "tag", "--points-at", revision)
+	if err != nil {
+		return
+	}
+	var best seedVersion
+	for _, tag := range strings.Fields(out) {
+		v, valid := parseVersion(tag)
+		if c, _ := canonicalVersion(tag); !valid || c != tag || v.Pre != "" {
+			continue
+		}
+		if mv, fits := modulePathMajor(modPath, tag, hasGoMod); fits && (!ok || v.compare(best) > 0) {
+			version, ok, best = mv, true, v
+		}
+	}
+	return
+}
+
+// gitModule describes the git package p, exported at its locked revision.
+func gitModule(p seedLockPackage) (m seedModule, err error) {
+	repoFolder, _, err := checkoutRepo(p.Name, p.Revision)
+	if err != nil {
+		return
+	}
+	gomod, err := ioutil.ReadFile(filepath.Join(repoFolder, goModFile))
+	hasGoMod := err == nil
+	if os.IsNotExist(err) {
+		gomod, err = []byte(fmt.Sprintf("module %s\n", p.Name)), nil
+	}
+	if err != nil {
+		return
+	}
+	mf := parseModFile(gomod)
+	m.Path, m.GoVersion = mf.Module, mf.Go
+	if m.Path == "" {
+		m.Path = p.Name
+	}
+
+	mirror, _, err := gitMirror(p.Name)
+	if err != nil {
+		return
+	}
+	version, ok := "", false
+	if v, valid := canonicalVersion(p.Version); valid && v == p.Version {
+		version, ok = modulePathMajor(m.Path, v, hasGoMod)
+	}
+	if !ok {
+		// a branch or commit that is tagged gets the version of its tag
+		version, ok = taggedVersion(mirror, p.Revision, m.Path, hasGoMod)
+	}
+	if !ok {
+		out, e := git(mirror, "show", "-s", "--format=%ct", p.Revision)
+		if e != nil {
+			err = e
+			return
+		}
+		sec, e := strconv.ParseInt(out, 10, 64)
+		if e != nil {
+			err = fmt.Errorf("commit time of %s: %s", p.Revision, e)
+			return
+		}
+		version = pseudoVersion(m.Path, p.Revision, time.Unix(sec, 0))
+	}
+	m.Version = version
+
+	files, err := dirModuleFiles(repoFolder, fmt.Sprintf("%s@%s/", m.Path, m.Version))
+	if err != nil {
+		return
+	}
+	if m.Sum, err = hashModule(files); err != nil {
+		return
+	}
+	m.ModSum, err = hashGoMod(gomod)
+	return
+}
+
+// seedArchiveModule describes the seed package p from its archive.
+func seedArchiveModule(p seedLockPackage) (m seedModule, err error) {
+	names := strings.Split(p.Name, "/")
+	if len(names) < 3 {
+		err = fmt.Errorf("invalid seed package: %s", p.Name)
+		return
+	}
+	zipPath, resolved, err := fetchSeed(names[1], names[2], p.Version)
+	if err != nil {
+		return
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+
+	m, gomod, files, err := archiveModule(&zr.Reader, names[1], names[2], resolved)
+	if err != nil {
+		return
+	}
+	if m.Sum, err = hashModule(files); err != nil {
+		return
+	}
+	m.ModSum, err = hashGoMod(gomod)
+	return
+}
+
+// archiveModule describes the module in the archive of org/name@version
+// with its go.mod (made up when the package has none) and its files, read
+// from zr.
+func archiveModule(zr *zip.Reader, org, name, version string) (m seedModule, gomod []byte, files []moduleFile, err error) {
+	pkg := fmt.Sprintf("goseed.io/%s/%s", org, name)
+	canonical, ok := canonicalVersion(version)
+	if !ok {
+		err = fmt.Errorf("%s@%s: not a semantic version, it cannot be a module", pkg, version)
+		return
+	}
+	top := fmt.Sprintf("%s-%s-%s", org, name, version)
+	gomod = []byte(fmt.Sprintf("module %s\n", pkg))
+	for _, f := range zr.File {
+		if f.Name == top+"/"+goModFile {
+			if gomod, err = readZipFile(f); err != nil {
+				return
+			}
+		}
+	}
+	mf := parseModFile(gomod)
+	m.Path, m.GoVersion = mf.Module, mf.Go
+	if m.Path == "" {
+		m.Path = pkg
+	}
+	if m.Version, ok = modulePathMajor(m.Path, canonical, mf.Module != ""); !ok {
+		err = fmt.Errorf("%s@%s: module path %s lacks the major version suffix", pkg, version, m.Path)
+		return
+	}
+	files = zipModuleFiles(zr, top, fmt.Sprintf("%s@%s/", m.Path, m.Version))
+	return
+}
+
+// vendorPackages lists the packages with Go files vendored for module,
+// nested modules excluded.
+func vendorPackages(vendor, module string) (packages []string, err error) {
+	root := filepath.Join(vendor, filepath.FromSlash(module))
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if _, e := os.Stat(filepath.Join(p, goModFile)); e == nil && p != root {
+			return filepath.SkipDir
+		}
+		files, _ := filepath.Glob(filepath.Join(p, "*.go"))
+		for _, f := range files {
+			if !strings.HasSuffix(f, "_test.go") {
+				rel, _ := filepath.Rel(vendor, p)
+				packages = append(packages, filepath.ToSlash(rel))
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// moveVendored moves the copy of a package made under its repository
+// path to the folder of its module path ("github.com/user/repo/v2"), what
+// was left there is replaced.
+func moveVendored(vendor, from, to string) (err error) {
+	src := filepath.Join(vendor, filepath.FromSlash(from))
+	dst := filepath.Join(vendor, filepath.FromSlash(to))
+	tmp := fmt.Sprintf("%s.seed-%d", src, os.Getpid())
+	if err = os.Rename(src, tmp); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return
+	}
+	err = replaceDir(tmp, dst)
+	return
+}
+
+// syncModules records the packages of lock, copied to vendor, on go.mod,
+// go.sum and vendor/modules.txt. direct are the packages the Seedfile asks
+// for, the others are indirect requirements. Modules of old missing on
+// lock are dropped. The module path of every package is set on lock.
+func syncModules(lock *seedLock, old seedLock, direct []string) (err error) {
+	mod, err := readModFile(goModFile)
+	if err != nil {
+		return
+	}
+	if mod.Replace {
+		log.Warningf("%s: replace directives are not vendored by seed\n", goModFile)
+	}
+	directRoots := map[string]bool{}
+	for _, d := range direct {
+		name, _, _ := splitDependency(d)
+		directRoots[repoRoot(name)] = true
+	}
+
+	var failed seedErrors
+	var modules []seedModule
+	var requires []seedModRequire
+	managed := map[string]bool{}
+	for i, p := range lock.Package {
+		var m seedModule
+		var e error
+		switch {
+		case isSeedPackage(p.Name):
+			m, e = seedArchiveModule(p)
+		case p.Sum != "":
+			m, e = proxyModule(p)
+		default:
+			m, e = gitModule(p)
+		}
+		if e == nil && m.Path != p.Name {
+			e = moveVendored("vendor", p.Name, m.Path)
+		}
+		if e == nil {
+			// the lock checks the folder the module ends up in
+			lock.Package[i].Checksum, e = dirChecksum(filepath.Join("vendor", filepath.FromSlash(m.Path)))
+		}
+		if e == nil {
+			m.Packages, e = vendorPackages("vendor", m.Path)
+		}
+		if e != nil {
+			failed.add(p.Name, stageCopy, e)
+			continue
+		}
+		lock.Package[i].Module = m.Path
+		managed[m.Path] = true
+		modules = append(modules, m)
+		requires = append(requires, seedModRequire{Path: m.Path, Version: m.Version, Indirect: !directRoots[p.Name]})
+	}
+	if err = failed.err(); err != nil {
+		return
+	}
+
+	remove := map[string]bool{}
+	for _, p := range old.Package {
+		if p.Module != "" && !managed[p.Module] {
+			remove[p.Module] = true
+		}
+	}
+	mod.setRequires(requires, remove)
+	if err = writeFileAtomic(goModFile, mod.bytes()); err != nil {
+		return
+	}
+	if err = writeGoSum(modules, managed, remove); err != nil {
+		return
+	}
+	err = writeModulesTxt(mod, modules)
+	return
+}
+
+// writeGoSum replaces the lines of seed modules on go.sum, other lines are
+// kept.
+func writeGoSum(modules []seedModule, managed, remove map[string]bool) (err error) {
+	var lines []string
+	if b, e := ioutil.ReadFile(goSumFile); e == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			f := strings.Fields(line)
+			if len(f) == 0 || managed[f[0]] || remove[f[0]] {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	} else if !os.IsNotExist(e) {
+		return e
+	}
+	for _, m := range modules {
+		lines = append(lines,
+			fmt.Sprintf("%s %s %s", m.Path, m.Version, m.Sum),
+			fmt.Sprintf("%s %s/go.mod %s", m.Path, m.Version, m.ModSum))
+	}
+	sort.Strings(lines)
+	var b []byte
+	if len(lines) > 0 {
+		b = []byte(strings.Join(lines, "\n") + "\n")
+	}
+	err = writeFileAtomic(goSumFile, b)
+	return
+}
+
+// readModulesTxt reads the entries of vendor/modules.txt by module path:
+// the "# path version" line and the lines below it.
+func readModulesTxt() (entries map[string][]string) {
+	entries = map[string][]string{}
+	b, err := ioutil.ReadFile(goModulesFile)
+	if err != nil {
+		return
+	}
+	current := ""
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "# ") {
+			current = ""
+			if f := strings.Fields(line); len(f) >= 3 {
+				current = f[1]
+			}
+		}
+		if current != "" && line != "" {
+			entries[current] = append(entries[current], line)
+		}
+	}
+	return
+}
+
+// writeModulesTxt lists every requirement of mod on vendor/modules.txt
+// with the packages vendored for it. Requirements modules does not
+// describe (installed earlier, as `seed get` only syncs what it fetched)
+// keep their entry when the version matches.
+func writeModulesTxt(mod seedModFile, modules []seedModule) (err error) {
+	byPath := map[string]seedModule{}
+	for _, m := range modules {
+		byPath[m.Path] = m
+	}
+	previous := readModulesTxt()
+	var buf bytes.Buffer
+	for _, r := range mod.Require {
+		m, ok := byPath[r.Path]
+		header := fmt.Sprintf("# %s %s", r.Path, r.Version)
+		if old := previous[r.Path]; !ok && len(old) > 0 && old[0] == header {
+			buf.WriteString(strings.Join(old, "\n") + "\n")
+			continue
+		}
+		buf.WriteString(header + "\n")
+		if !ok {
+			log.Warningf("%s %s is not vendored by seed\n", r.Path, r.Version)
+			buf.WriteString("## explicit\n")
+			continue
+		}
+		if m.GoVersion != "" {
+			fmt.Fprintf(&buf, "## explicit; go %s\n", m.GoVersion)
+		} else {
+			buf.WriteString("## explicit\n")
+		}
+		for _, p := range m.Packages {
+			fmt.Fprintln(&buf, p)
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(goModulesFile), os.ModePerm); err != nil {
+		return
+	}
+	err = writeFileAtomic(goModulesFile, buf.Bytes())
+	return
+}
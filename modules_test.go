@@ -0,0 +1,142 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModFile(t *testing.T) {
+	tests := []struct {
+		desc    string
+		gomod   string
+		module  string
+		goVer   string
+		require []string
+		replace bool
+	}{
+		{
+			desc:    "single line require",
+			gomod:   "module example.com/m\n\ngo 1.16\n\nrequire example.com/a v1.0.0\n",
+			module:  "example.com/m",
+			goVer:   "1.16",
+			require: []string{"example.com/a v1.0.0"},
+		},
+		{
+			desc:    "require block",
+			gomod:   "module example.com/m\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v0.2.0 // indirect\n)\n",
+			module:  "example.com/m",
+			require: []string{"example.com/a v1.0.0", "example.com/b v0.2.0 // indirect"},
+		},
+		{
+			desc:    "require block without space",
+			gomod:   "module example.com/m\n\nrequire(\n\texample.com/a v1.0.0\n)\n",
+			module:  "example.com/m",
+			require: []string{"example.com/a v1.0.0"},
+		},
+		{
+			desc:    "comments",
+			gomod:   "// the module\nmodule \"example.com/m\" // quoted\n\nrequire (\n\t// pinned\n\texample.com/a v1.0.0 // indirect; see #12\n\texample.com/b v1.0.0 // keep\n)\n",
+			module:  "example.com/m",
+			require: []string{"example.com/a v1.0.0 // indirect; see #12", "example.com/b v1.0.0 // keep"},
+		},
+		{
+			desc:    "replace and exclude blocks",
+			gomod:   "module example.com/m\n\nrequire example.com/a v1.0.0\n\nreplace (\n\texample.com/a => ../a\n)\n\nexclude (\n\texample.com/a v0.9.0\n)\n",
+			module:  "example.com/m",
+			require: []string{"example.com/a v1.0.0"},
+			replace: true,
+		},
+	}
+	for _, tt := range tests {
+		f := parseModFile([]byte(tt.gomod))
+		var require []string
+		for _, r := range f.Require {
+			require = append(require, r.String())
+		}
+		if f.Module != tt.module || f.Go != tt.goVer || f.Replace != tt.replace || !reflect.DeepEqual(require, tt.require) {
+			t.Errorf("%s: parseModFile = %q %q %v %q, want %q %q %v %q", tt.desc,
+				f.Module, f.Go, f.Replace, require, tt.module, tt.goVer, tt.replace, tt.require)
+		}
+	}
+}
+
+func TestSetRequires(t *testing.T) {
+	tests := []struct {
+		desc   string
+		gomod  string
+		set    []seedModRequire
+		remove []string
+		want   string
+	}{
+		{
+			desc:  "update single line",
+			gomod: "module example.com/m\n\ngo 1.16\n\nrequire example.com/a v1.0.0\n",
+			set:   []seedModRequire{{Path: "example.com/a", Version: "v1.1.0"}},
+			want:  "module example.com/m\n\ngo 1.16\n\nrequire example.com/a v1.1.0\n",
+		},
+		{
+			desc:   "drop single line",
+			gomod:  "module example.com/m\n\ngo 1.16\n\nrequire example.com/a v1.0.0\n",
+			remove: []string{"example.com/a"},
+			want:   "module example.com/m\n\ngo 1.16\n",
+		},
+		{
+			desc:  "add without require",
+			gomod: "module example.com/m\n\ngo 1.16\n",
+			set:   []seedModRequire{{Path: "example.com/a", Version: "v1.0.0"}, {Path: "example.com/b", Version: "v0.1.0", Indirect: true}},
+			want:  "module example.com/m\n\ngo 1.16\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v0.1.0 // indirect\n)\n",
+		},
+		{
+			desc:  "update and add to the last block",
+			gomod: "module example.com/m\n\nrequire (\n\texample.com/a v1.0.0\n)\n\nrequire (\n\texample.com/b v1.0.0 // indirect\n)\n",
+			set:   []seedModRequire{{Path: "example.com/a", Version: "v1.2.0"}, {Path: "example.com/c", Version: "v1.0.0", Indirect: true}},
+			want:  "module example.com/m\n\nrequire (\n\texample.com/a v1.2.0\n)\n\nrequire (\n\texample.com/b v1.0.0 // indirect\n\texample.com/c v1.0.0 // indirect\n)\n",
+		},
+		{
+			desc:  "block without space",
+			gomod: "module example.com/m\n\nrequire(\n\texample.com/a v1.0.0\n)\n",
+			set:   []seedModRequire{{Path: "example.com/a", Version: "v1.1.0"}, {Path: "example.com/b", Version: "v1.0.0"}},
+			want:  "module example.com/m\n\nrequire(\n\texample.com/a v1.1.0\n\texample.com/b v1.0.0\n)\n",
+		},
+		{
+			desc:   "drop the block left empty",
+			gomod:  "module example.com/m\n\nrequire example.com/keep v1.0.0\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/b v1.0.0 // indirect\n)\n",
+			remove: []string{"example.com/a", "example.com/b"},
+			want:   "module example.com/m\n\nrequire example.com/keep v1.0.0\n",
+		},
+		{
+			desc:   "drop the block without space left empty",
+			gomod:  "module example.com/m\n\nrequire(\n\texample.com/a v1.0.0\n)\n",
+			remove: []string{"example.com/a"},
+			want:   "module example.com/m\n",
+		},
+		{
+			desc:  "keep comments",
+			gomod: "module example.com/m\n\nrequire (\n\t// pinned, see #12\n\texample.com/a v1.0.0 // indirect\n\texample.com/b v1.0.0 // indirect; old API\n\texample.com/c v1.0.0 // fork\n\texample.com/d v1.0.0 // indirect\n)\n",
+			set: []seedModRequire{
+				{Path: "example.com/a", Version: "v1.1.0", Indirect: true},
+				{Path: "example.com/b", Version: "v1.1.0", Indirect: true},
+				{Path: "example.com/c", Version: "v1.1.0"},
+			},
+			want: "module example.com/m\n\nrequire (\n\t// pinned, see #12\n\texample.com/a v1.1.0 // indirect\n\texample.com/b v1.1.0 // indirect; old API\n\texample.com/c v1.1.0 // fork\n\texample.com/d v1.0.0 // indirect\n)\n",
+		},
+		{
+			desc:   "leave replace and exclude alone",
+			gomod:  "module example.com/m\n\nrequire example.com/a v1.0.0\n\nreplace (\n\texample.com/a => ../a\n)\n\nexclude (\n\texample.com/a v0.9.0\n)\n",
+			set:    []seedModRequire{{Path: "example.com/b", Version: "v1.0.0"}},
+			remove: []string{"example.com/a"},
+			want:   "module example.com/m\n\nreplace (\n\texample.com/a => ../a\n)\n\nexclude (\n\texample.com/a v0.9.0\n)\n\nrequire (\n\texample.com/b v1.0.0\n)\n",
+		},
+	}
+	for _, tt := range tests {
+		f := parseModFile([]byte(tt.gomod))
+		remove := map[string]bool{}
+		for _, p := range tt.remove {
+			remove[p] = true
+		}
+		f.setRequires(tt.set, remove)
+		if got := string(f.bytes()); got != tt.want {
+			t.Errorf("%s: setRequires =\n%s\nwant\n%s", tt.desc, got, tt.want)
+		}
+	}
+}
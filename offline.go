@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SeedOffline keeps seed from touching the network (install --offline):
+// git mirrors are used as they are, seed archives and modules come from
+// the cache or from file:// sources and proxies.
+var SeedOffline bool
+
+// seedOfflineError is something seed would have to download while offline.
+type seedOfflineError struct {
+	What string
+}
+
+func (e *seedOfflineError) Error() string {
+	return fmt.Sprintf("%s is not in the cache (offline)", e.What)
+}
+
+// isLocal reports whether a source or proxy URL is a folder, usable offline.
+func isLocal(url string) bool {
+	return strings.HasPrefix(url, "file://")
+}
+
+// offlineRemote finds the repository of importPath among the cached git
+// mirrors, the longest matching root wins.
+func offlineRemote(importPath string) (remote gitRemote, err error) {
+	names := strings.Split(importPath, "/")
+	for i := len(names); i > 0; i-- {
+		root := strings.Join(names[:i], "/")
+		if _, e := os.Stat(filepath.Join(SeedCachePath, "git", fmt.Sprintf("%s.git", root))); e == nil {
+			remote.Root = root
+			return
+		}
+	}
+	err = &seedOfflineError{What: importPath}
+	return
+}
+
+// cachedSeedVersions lists the versions of a seed package on the cache.
+func cachedSeedVersions(org, name string) (versions []string) {
+	prefix := filepath.Join(SeedCachePath, fmt.Sprintf("%s-%s-", org, name))
+	files, _ := filepath.Glob(prefix + "*.zip")
+	for _, f := range files {
+		if v := strings.TrimSuffix(strings.TrimPrefix(f, prefix), ".zip"); validIndexPath(v) == nil {
+			versions = append(versions, v)
+		}
+	}
+	return
+}
+
+// cachedModuleVersions lists the versions of a module downloaded to the
+// cache.
+func cachedModuleVersions(modPath string) (versions []string) {
+	dir := filepath.Join(SeedCachePath, "download", filepath.FromSlash(escapeModulePath(modPath)), "@v")
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ziphash"))
+	for _, f := range files {
+		if v, err := unescapeModulePath(strings.TrimSuffix(filepath.Base(f), ".ziphash")); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return
+}
+
+// missing lists the packages of the lock that cannot be installed
+// offline, as name@version.
+func (l seedLock) missing() (missing []string) {
+	for _, p := range l.Package {
+		if !offlineAvailable(p) {
+			missing = append(missing, fmt.Sprintf("%s@%s", p.Name, p.Version))
+		}
+	}
+	return
+}
+
+func offlineAvailable(p seedLockPackage) bool {
+	switch {
+	case p.Revision != "":
+		root := p.Name
+		if remote, err := offlineRemote(p.Name); err == nil {
+			root = remote.Root
+		}
+		if _, err := os.Stat(filepath.Join(SeedCachePath, "src", fmt.Sprintf("%s@%s", root, p.Revision))); err == nil {
+			return true
+		}
+		mirror := filepath.Join(SeedCachePath, "git", fmt.Sprintf("%s.git", root))
+		_, err := git(mirror, "cat-file", "-e", fmt.Sprintf("%s^{commit}", p.Revision))
+		return err == nil
+	case p.Sum != "":
+		base, dir := moduleCachePaths(p.Name, p.Version)
+		if _, err := os.Stat(dir); err == nil {
+			if _, err = os.Stat(base + ".ziphash"); err == nil {
+				return true
+			}
+		}
+		if isLocal(SeedProxy) {
+			zip := fmt.Sprintf("%s/@v/%s.zip", escapeModulePath(p.Name), escapeModulePath(p.Version))
+			_, err := os.Stat(filepath.Join(strings.TrimPrefix(SeedProxy, "file://"), filepath.FromSlash(zip)))
+			return err == nil
+		}
+		return false
+	}
+	names := strings.Split(p.Name, "/")
+	if len(names) < 3 {
+		return false
+	}
+	if _, err := os.Stat(fmt.Sprintf("%s/%s-%s-%s.zip", SeedCachePath, names[1], names[2], p.Version)); err == nil {
+		return true
+	}
+	for _, source := range SeedSources {
+		if idx, ok := source.local(); ok {
+			if _, err := os.Stat(idx.zipPath(names[1], names[2], p.Version)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nuveo/log"
+)
+
+// Packages outside goseed.io are fetched with git unless a Go module proxy
+// is set (`proxy` on [seed] or --proxy), then they are downloaded as
+// module zips and no git or VCS credentials are needed:
+//
+//	<cache>/download/<module>/@v/<version>.info, .mod, .zip and .ziphash
+//	<cache>/mod/<module>@<version>, the unpacked module
+//
+// Packages are then named by module path. The download folder is laid out
+// as a proxy, so a file:// proxy can point to a copy of it (or to the
+// GOMODCACHE/cache/download of a machine with network access).
+
+// SeedProxy is the module proxy in use, empty fetches with git.
+var SeedProxy string
+
+var (
+	proxyMu      sync.Mutex
+	proxyModules = map[string]string{} // import path => module path
+)
+
+var errNoProxy = errors.New("no module proxy set, use proxy on the [seed] section or --proxy")
+
+// setProxy sets the module proxy, "direct" and "off" mean git.
+func setProxy(proxy string) {
+	switch proxy = strings.TrimRight(proxy, "/"); proxy {
+	case "direct", "off":
+		proxy = ""
+	}
+	SeedProxy = proxy
+}
+
+// proxyGet opens rel ("<module>/@v/list") on the proxy. Missing files
+// are *seedStatusError with a 404 (or 410) status, or os.IsNotExist errors
+// for file:// proxies.
+func proxyGet(rel string) (body io.ReadCloser, err error) {
+	if SeedProxy == "" {
+		err = errNoProxy
+		return
+	}
+	if SeedOffline && !isLocal(SeedProxy) {
+		err = &seedOfflineError{What: rel}
+		return
+	}
+	if strings.HasPrefix(SeedProxy, "file://") {
+		body, err = os.Open(filepath.Join(strings.TrimPrefix(SeedProxy, "file://"), filepath.FromSlash(rel)))
+		return
+	}
+	u := fmt.Sprintf("%s/%s", SeedProxy, rel)
+	resp, err := seedHTTPClient.Get(u)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		err = &seedStatusError{URL: u, Message: strings.TrimSpace(string(b)), StatusCode: resp.StatusCode}
+		return
+	}
+	body = resp.Body
+	return
+}
+
+func proxyRead(rel string) (b []byte, err error) {
+	body, err := proxyGet(rel)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	b, err = ioutil.ReadAll(io.LimitReader(body, 1<<20))
+	return
+}
+
+// proxyNotFound tells a module or version the proxy does not have from a
+// failure to talk to it.
+func proxyNotFound(err error) bool {
+	if _, offline := err.(*seedOfflineError); offline {
+		return true
+	}
+	e, ok := err.(*seedStatusError)
+	return os.IsNotExist(err) || (ok && (e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone))
+}
+
+// proxyDownload saves rel to dst, dst only appears once complete.
+func proxyDownload(rel, dst string) (err error) {
+	body, err := proxyGet(rel)
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".download-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(body, seedMaxArchiveSize+1))
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if n > seedMaxArchiveSize {
+		err = fmt.Errorf("%s: too large", rel)
+		return
+	}
+	err = os.Rename(tmp.Name(), dst)
+	return
+}
+
+// proxyVersions lists the versions of a module on the proxy, offline
+// those on the cache unless the proxy is a folder.
+func proxyVersions(modPath string) (versions []string, err error) {
+	if SeedOffline && !isLocal(SeedProxy) {
+		if versions = cachedModuleVersions(modPath); len(versions) == 0 {
+			err = &seedOfflineError{What: modPath}
+		}
+		return
+	}
+	b, err := proxyRead(fmt.Sprintf("%s/@v/list", escapeModulePath(modPath)))
+	if err != nil {
+		return
+	}
+	versions = strings.Fields(string(b))
+	return
+}
+
+// proxyResolve turns version into the module version it stands for: a
+// canonical version is used as is, "latest" is the newest listed version,
+// branches and commits are asked to the proxy.
+func proxyResolve(modPath, version string) (resolved string, err error) {
+	if c, ok := canonicalVersion(version); ok && (c == version || strings.HasPrefix(version, c+"+")) {
+		resolved = version
+		return
+	}
+	rel := fmt.Sprintf("%s/@v/%s.info", escapeModulePath(modPath), escapeModulePath(version))
+	if version == "" || version == "latest" {
+		// the newest listed version, as the go tool does, @latest
+		// only for modules without tagged versions
+		versions, e := proxyVersions(modPath)
+		if e == nil && len(versions) > 0 {
+			resolved = latestVersion(versions)
+			return
+		}
+		rel = fmt.Sprintf("%s/@latest", escapeModulePath(modPath))
+	}
+	b, err := proxyRead(rel)
+	if err != nil {
+		return
+	}
+	var info seedModuleInfo
+	if err = json.Unmarshal(b, &info); err != nil || info.Version == "" {
+		err = fmt.Errorf("%s@%s: invalid version info from %s", modPath, version, SeedProxy)
+		return
+	}
+	resolved = info.Version
+	return
+}
+
+// proxyModulePath finds the module holding importPath, the longest of its
+// prefixes the proxy knows.
+func proxyModulePath(importPath string) (modPath string, err error) {
+	proxyMu.Lock()
+	modPath, ok := proxyModules[importPath]
+	proxyMu.Unlock()
+	if ok {
+		return
+	}
+
+	names := strings.Split(importPath, "/")
+	for i := len(names); i > 0 && modPath == ""; i-- {
+		candidate := strings.Join(names[:i], "/")
+		versions, e := proxyVersions(candidate)
+		if e == nil && len(versions) == 0 {
+			_, e = proxyRead(fmt.Sprintf("%s/@latest", escapeModulePath(candidate)))
+		}
+		switch {
+		case e == nil:
+			modPath = candidate
+		case !proxyNotFound(e):
+			err = e
+			return
+		}
+	}
+	if modPath == "" {
+		err = fmt.Errorf("%s: no module found on %s", importPath, SeedProxy)
+		return
+	}
+	proxyMu.Lock()
+	proxyModules[importPath] = modPath
+	proxyMu.Unlock()
+	return
+}
+
+// moduleCachePaths are the download base (<base>.zip, <base>.mod...) and
+// the unpacked folder of a module version on the cache.
+func moduleCachePaths(modPath, version string) (base, dir string) {
+	escaped := filepath.FromSlash(escapeModulePath(modPath))
+	base = filepath.Join(SeedCachePath, "download", escaped, "@v", escapeModulePath(version))
+	dir = filepath.Join(SeedCachePath, "mod", fmt.Sprintf("%s@%s", escaped, escapeModulePath(version)))
+	return
+}
+
+// hashModuleZip is the h1: hash of a module zip, every file must live
+// below <module>@<version>/.
+func hashModuleZip(zipPath, modPath, version string) (sum string, err error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+	prefix := fmt.Sprintf("%s@%s/", modPath, version)
+	var files []moduleFile
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, prefix) {
+			err = fmt.Errorf("%s@%s: %s is outside of the module", modPath, version, f.Name)
+			return
+		}
+		if f.Mode().IsDir() {
+			continue
+		}
+		files = append(files, moduleFile{Name: f.Name, Open: f.Open})
+	}
+	sum, err = hashModule(files)
+	return
+}
+
+// goSumLines returns the hashes go.sum records for a module version.
+func goSumLines(modPath, version string) (zipSum, modSum string) {
+	b, err := ioutil.ReadFile(goSumFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) != 3 || f[0] != modPath {
+			continue
+		}
+		switch f[1] {
+		case version:
+			zipSum = f[2]
+		case version + "/go.mod":
+			modSum = f[2]
+		}
+	}
+	return
+}
+
+// checkGoSum checks a downloaded module against the project go.sum, found
+// tells whether go.sum has it.
+func checkGoSum(modPath, version, sum, modFile string) (found bool, err error) {
+	key := fmt.Sprintf("%s@%s", modPath, version)
+	zipSum, modSum := goSumLines(modPath, version)
+	found = zipSum != ""
+	if zipSum != "" && zipSum != sum {
+		err = &seedChecksumError{Key: key, Source: goSumFile, Expected: zipSum, Got: sum}
+		return
+	}
+	if modSum == "" {
+		return
+	}
+	b, err := ioutil.ReadFile(modFile)
+	if err != nil {
+		return
+	}
+	got, err := hashGoMod(b)
+	if err == nil && got != modSum {
+		err = &seedChecksumError{Key: key + "/go.mod", Source: goSumFile, Expected: modSum, Got: got}
+	}
+	return
+}
+
+// checkModule checks the h1: hash of a module version against locked (the
+// hash Seedfile.lock records, if any) and go.sum. Fresh downloads neither
+// of them knows are looked up on the checksum database.
+func checkModule(modPath, version, sum, modFile, locked string, fresh bool) (err error) {
+	if locked != "" && sum != locked {
+		err = &seedChecksumError{Key: fmt.Sprintf("%s@%s", modPath, version), Source: SeedLockFile, Expected: locked, Got: sum}
+		return
+	}
+	found, err := checkGoSum(modPath, version, sum, modFile)
+	if err != nil || found || locked != "" || !fresh {
+		return
+	}
+	err = checkSumDB(modPath, version, sum, modFile)
+	return
+}
+
+// downloadModule makes modPath@version available unpacked on the cache
+// and returns its folder with its h1: hash. The zip is checked against
+// locked, go.sum or the checksum database before anything is unpacked.
+func downloadModule(modPath, version, locked string) (dir, sum string, err error) {
+	base, dir := moduleCachePaths(modPath, version)
+	unlock := lockRepo(dir)
+	defer unlock()
+
+	if b, e := ioutil.ReadFile(base + ".ziphash"); e == nil {
+		if _, e = os.Stat(dir); e == nil {
+			touchCache(dir)
+			sum = strings.TrimSpace(string(b))
+			err = checkModule(modPath, version, sum, base+".mod", locked, false)
+			return
+		}
+	}
+
+	if err = os.MkdirAll(filepath.Dir(base), os.ModePerm); err != nil {
+		return
+	}
+	rel := fmt.Sprintf("%s/@v/%s", escapeModulePath(modPath), escapeModulePath(version))
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if _, e := os.Stat(base + ext); e == nil {
+			continue
+		}
+		if err = proxyDownload(rel+ext, base+ext); err != nil {
+			return
+		}
+	}
+	sum, err = hashModuleZip(base+".zip", modPath, version)
+	if err == nil {
+		err = checkModule(modPath, version, sum, base+".mod", locked, true)
+	}
+	if err != nil {
+		os.Remove(base + ".zip")
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dir), os.ModePerm); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), ".extract-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmp)
+	if err = extractZip(base+".zip", tmp); err != nil {
+		return
+	}
+	src := filepath.Join(tmp, filepath.FromSlash(fmt.Sprintf("%s@%s", modPath, version)))
+	if err = replaceDir(src, dir); err != nil {
+		return
+	}
+	err = writeFileAtomic(base+".ziphash", []byte(sum+"\n"))
+	return
+}
+
+// fetchModule resolves version of the module modPath on the proxy and
+// downloads it, returning the unpacked folder, the module version and
+// its h1: hash. locked is the hash it must have, when known.
+func fetchModule(modPath, version, locked string) (dir, resolved, sum string, err error) {
+	resolved, err = proxyResolve(modPath, version)
+	if err != nil {
+		err = stageError(modPath, stageResolve, err)
+		return
+	}
+	dir, sum, err = downloadModule(modPath, resolved, locked)
+	switch err.(type) {
+	case nil:
+	case *seedChecksumError:
+		err = stageError(modPath, stageVerify, err)
+	default:
+		err = stageError(modPath, stageFetch, err)
+	}
+	return
+}
+
+// getByProxy copies the module repo at version from the proxy into
+// seedFolder, the same way getRepo copies a git repository. locked is the
+// h1: hash Seedfile.lock records for it, if any.
+func getByProxy(repo, version, locked, seedFolder string, tests bool) (dst, resolved, sum string, err error) {
+	modFolder, resolved, sum, err := fetchModule(repo, version, locked)
+	if err != nil {
+		return
+	}
+	log.Println(fmt.Sprintf(GetMsgLog, repo, resolved))
+	dst, err = copyRepo(repo, modFolder, seedFolder, tests)
+	return
+}
+
+// proxyModule describes the module of a package fetched from the proxy.
+func proxyModule(p seedLockPackage) (m seedModule, err error) {
+	_, sum, err := downloadModule(p.Name, p.Version, p.Sum)
+	if err != nil {
+		return
+	}
+	base, _ := moduleCachePaths(p.Name, p.Version)
+	gomod, err := ioutil.ReadFile(base + ".mod")
+	if err != nil {
+		return
+	}
+	m = seedModule{Path: p.Name, Version: p.Version, GoVersion: parseModFile(gomod).Go, Sum: sum}
+	m.ModSum, err = hashGoMod(gomod)
+	return
+}
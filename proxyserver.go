@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The index also serves its packages to the go tool as a module proxy
+// (https://go.dev/ref/mod#goproxy-protocol), GOPROXY=http://host:port:
+//
+//	/goseed.io/<org>/<name>/@v/list          versions, one per line
+//	/goseed.io/<org>/<name>/@v/<version>.info {"Version", "Time"}
+//	/goseed.io/<org>/<name>/@v/<version>.mod  go.mod
+//	/goseed.io/<org>/<name>/@v/<version>.zip  module zip
+//	/goseed.io/<org>/<name>/@latest           .info of the newest version
+//
+// A package version 1.2 is the module version v1.2.0. From v2 on the module
+// path carries the major version (goseed.io/org/name/v2) when the package
+// has a go.mod, otherwise the version is "+incompatible".
+
+// seedModuleInfo is the .info of a module version.
+type seedModuleInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// escapeModulePath and unescapeModulePath apply the case encoding of
+// module paths and versions on proxies: "!x" stands for "X".
+func escapeModulePath(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func unescapeModulePath(s string) (path string, err error) {
+	var b strings.Builder
+	bang := false
+	for _, r := range s {
+		switch {
+		case r >= utf8.RuneSelf || ('A' <= r && r <= 'Z'):
+			err = fmt.Errorf("invalid escaped path: %q", s)
+			return
+		case r == '!' && !bang:
+			bang = true
+			continue
+		case bang && 'a' <= r && r <= 'z':
+			r -= 'a' - 'A'
+		case bang:
+			err = fmt.Errorf("invalid escaped path: %q", s)
+			return
+		}
+		bang = false
+		b.WriteRune(r)
+	}
+	if bang {
+		err = fmt.Errorf("invalid escaped path: %q", s)
+		return
+	}
+	path = b.String()
+	return
+}
+
+// splitModulePath reads the organization and name of the package a module
+// path of the index refers to.
+func splitModulePath(modPath string) (org, name string, err error) {
+	names := strings.Split(modPath, "/")
+	if len(names) == 4 && strings.HasPrefix(names[3], "v") {
+		names = names[:3]
+	}
+	if len(names) != 3 || names[0] != "goseed.io" {
+		err = fmt.Errorf("not a seed module: %s", modPath)
+		return
+	}
+	org, name = names[1], names[2]
+	err = validIndexPath(org, name)
+	return
+}
+
+// openModule opens the archive of a version and describes its module, the
+// files are readable until zr is closed.
+func (idx *seedIndex) openModule(org, name, version string) (zr *zip.ReadCloser, m seedModule, gomod []byte, files []moduleFile, err error) {
+	zr, err = zip.OpenReader(idx.zipPath(org, name, version))
+	if err != nil {
+		return
+	}
+	m, gomod, files, err = archiveModule(&zr.Reader, org, name, version)
+	if err != nil {
+		zr.Close()
+	}
+	return
+}
+
+// moduleVersions maps the module versions of modPath to the versions of
+// the package they were pushed as. Versions that are not semantic or
+// belong to another major version are left out.
+func (idx *seedIndex) moduleVersions(modPath string) (org, name string, versions map[string]string, err error) {
+	org, name, err = splitModulePath(modPath)
+	if err != nil {
+		return
+	}
+	pkg, err := idx.loadPackage(org, name)
+	if err != nil {
+		return
+	}
+	versions = map[string]string{}
+	for _, v := range pkg.Versions {
+		zr, m, _, _, e := idx.openModule(org, name, v)
+		if e != nil {
+			continue
+		}
+		zr.Close()
+		if m.Path == modPath {
+			versions[m.Version] = v
+		}
+	}
+	return
+}
+
+// handleModules serves the module proxy protocol for the packages of the
+// index. Errors are plain text as the go tool prints them.
+func (idx *seedIndex) handleModules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	escaped, file := "", ""
+	switch {
+	case strings.HasSuffix(p, "/@latest"):
+		escaped = strings.TrimSuffix(p, "/@latest")
+	case strings.Contains(p, "/@v/"):
+		i := strings.LastIndex(p, "/@v/")
+		escaped, file = p[:i], p[i+len("/@v/"):]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	modPath, err := unescapeModulePath(escaped)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	org, name, versions, err := idx.moduleVersions(modPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("not found: %s", modPath), http.StatusNotFound)
+		return
+	}
+
+	if file == "list" {
+		var list []string
+		for v := range versions {
+			list = append(list, v)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			a, _ := parseVersion(list[i])
+			b, _ := parseVersion(list[j])
+			return a.compare(b) < 0
+		})
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range list {
+			fmt.Fprintln(w, v)
+		}
+		return
+	}
+
+	version := ""
+	if file == "" {
+		var pushed []string
+		for _, v := range versions {
+			pushed = append(pushed, v)
+		}
+		version = latestVersion(pushed)
+	} else {
+		ext := path.Ext(file)
+		modVersion, e := unescapeModulePath(strings.TrimSuffix(file, ext))
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		version = versions[modVersion]
+		if ext != ".info" && ext != ".mod" && ext != ".zip" {
+			version = ""
+		}
+		file = ext
+	}
+	if version == "" {
+		http.Error(w, fmt.Sprintf("not found: %s: unknown version", modPath), http.StatusNotFound)
+		return
+	}
+
+	zr, m, gomod, files, err := idx.openModule(org, name, version)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer zr.Close()
+
+	switch file {
+	case "", ".info":
+		info := seedModuleInfo{Version: m.Version}
+		if st, e := os.Stat(idx.zipPath(org, name, version)); e == nil {
+			info.Time = st.ModTime().UTC().Truncate(time.Second)
+		}
+		writeJSON(w, http.StatusOK, info)
+	case ".mod":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write(gomod)
+	case ".zip":
+		w.Header().Set("Content-Type", "application/zip")
+		if r.Method == http.MethodHead {
+			return
+		}
+		_ = writeModuleZip(w, files)
+	}
+}
+
+// writeModuleZip writes files as a module zip, the h1: hash the go tool
+// computes from it is the one seed records on go.sum.
+func writeModuleZip(w io.Writer, files []moduleFile) (err error) {
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		dst, e := zw.Create(f.Name)
+		if e != nil {
+			return e
+		}
+		src, e := f.Open()
+		if e != nil {
+			return e
+		}
+		_, err = io.Copy(dst, src)
+		src.Close()
+		if err != nil {
+			return
+		}
+	}
+	err = zw.Close()
+	return
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/nuveo/log"
+)
+
+// seedRootRequirer names the requirements coming from the command line or
+// the project Seedfile.
+const seedRootRequirer = "Seedfile"
+
+// seedRequirement is what one package (the requirer) asks of another.
+// An empty Constraint comes from a plain import and accepts any version,
+// Module is set when it comes from the go.mod of the requirer. Chain lists
+// the requirers from the Seedfile down to the requirer.
+type seedRequirement struct {
+	Constraint string
+	Module     bool
+	Chain      []string
+}
+
+// seedDependency is an edge found while expanding a package. Checksum
+// is the archive hash a Seedfile pinned next to it, if any. Module tells
+// the constraint was read from go.mod.
+type seedDependency struct {
+	Name       string
+	Constraint string
+	Checksum   string
+	Module     bool
+}
+
+// seedNode is a repository of the graph, Packages are the import paths
+// of it that are required and whose imports are followed.
+type seedNode struct {
+	Name     string
+	Version  string
+	Packages map[string]bool
+	Requires map[string]seedRequirement
+	deps     []seedDependency
+	expanded bool
+}
+
+// seedResolver builds the whole dependency graph before anything is
+// copied, so every repository ends with a single version compatible with
+// all of its requirers. Repositories are fetched once per version, up to
+// jobs of them at the same time.
+type seedResolver struct {
+	nodes     map[string]*seedNode
+	versions  map[string][]string
+	checkouts map[string]string
+	jobs      int
+	mu        sync.Mutex
+}
+
+func newResolver(jobs int) *seedResolver {
+	return &seedResolver{
+		jobs:      jobs,
+		nodes:     map[string]*seedNode{},
+		versions:  map[string][]string{},
+		checkouts: map[string]string{},
+	}
+}
+
+// seedResolved is a package picked by the resolver, Chain shows why it is
+// installed.
+type seedResolved struct {
+	Name    string
+	Version string
+	Chain   []string
+}
+
+// splitDependency reads a Seedfile dependency, "import/path@version" with
+// an optional archive checksum after a space: "... sha256:<hex>".
+func splitDependency(dependence string) (name, version, checksum string) {
+	fields := strings.Fields(dependence)
+	if len(fields) == 0 {
+		return
+	}
+	if len(fields) > 1 {
+		checksum = fields[1]
+	}
+	repo := strings.SplitN(fields[0], "@", 2)
+	name = repo[0]
+	if len(repo) == 2 {
+		version = repo[1]
+	}
+	return
+}
+
+func (r *seedResolver) node(name string) *seedNode {
+	n, ok := r.nodes[name]
+	if !ok {
+		n = &seedNode{
+			Name:     name,
+			Packages: map[string]bool{},
+			Requires: map[string]seedRequirement{},
+		}
+		r.nodes[name] = n
+	}
+	return n
+}
+
+// require records that requirer needs the package pkg, a package not seen
+// before on its repository makes the repository expand again. What the
+// Seedfile of requirer asks for is kept over its go.mod and plain imports.
+func (r *seedResolver) require(pkg, requirer, constraint string, module bool, chain []string) {
+	n := r.node(repoRoot(pkg))
+	if !n.Packages[pkg] {
+		n.Packages[pkg] = true
+		n.expanded = false
+	}
+	if old, ok := n.Requires[requirer]; ok && (constraint == "" || (module && !old.Module && old.Constraint != "")) {
+		constraint, module = old.Constraint, old.Module
+	}
+	n.Requires[requirer] = seedRequirement{Constraint: constraint, Module: module, Chain: chain}
+}
+
+func (n *seedNode) packages() (packages []string) {
+	for p := range n.Packages {
+		packages = append(packages, p)
+	}
+	sort.Strings(packages)
+	return
+}
+
+func (r *seedResolver) names() (names []string) {
+	for name := range r.nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// reachable returns the packages still required from the root, a package
+// may be left behind when its requirer moved to a version without it.
+func (r *seedResolver) reachable() map[string]bool {
+	seen := map[string]bool{}
+	var walk func(name string)
+	walk = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		for _, d := range r.nodes[name].deps {
+			walk(repoRoot(d.Name))
+		}
+	}
+	for _, name := range r.names() {
+		if _, ok := r.nodes[name].Requires[seedRootRequirer]; ok {
+			walk(name)
+		}
+	}
+	return seen
+}
+
+// requirements are the live requirements of n, sorted by requirer.
+func (r *seedResolver) requirements(n *seedNode, live map[string]bool) (requirers []string) {
+	for requirer := range n.Requires {
+		if requirer == seedRootRequirer || live[requirer] {
+			requirers = append(requirers, requirer)
+		}
+	}
+	sort.Strings(requirers)
+	return
+}
+
+func (r *seedResolver) availableVersions(name string) (versions []string, err error) {
+	versions, ok := r.versions[name]
+	if ok {
+		return
+	}
+	versions, err = availableVersions(name)
+	if err != nil {
+		return
+	}
+	r.versions[name] = versions
+	return
+}
+
+// choose picks the version of n satisfying all of its requirements. At
+// most one branch, tag or exact version may be asked for, and it must
+// match every constraint; otherwise the highest version matching all
+// constraints wins. The lowest versions go.mod files ask for only apply
+// when the Seedfiles leave room for them.
+func (r *seedResolver) choose(n *seedNode, live map[string]bool) (version string, err error) {
+	var literal, literalBy string
+	var constraint, floors seedConstraint
+	requirers := r.requirements(n, live)
+	for _, requirer := range requirers {
+		req := n.Requires[requirer]
+		if req.Constraint == "" {
+			continue
+		}
+		if c, ok := parseConstraint(req.Constraint); ok {
+			if req.Module {
+				floors = append(floors, c...)
+			} else {
+				constraint = append(constraint, c...)
+			}
+			continue
+		}
+		if literal != "" && literal != req.Constraint {
+			err = r.conflict(n, requirers, fmt.Sprintf("both %s and %s are required", literal, req.Constraint))
+			return
+		}
+		literal, literalBy = req.Constraint, requirer
+	}
+
+	switch {
+	case literal != "" && len(constraint) == 0:
+		version = literal
+	case literal != "":
+		if v, ok := parseVersion(literal); ok && constraint.match(v) {
+			version = literal
+			return
+		}
+		err = r.conflict(n, requirers, fmt.Sprintf("%s required by %s does not match the other constraints", literal, literalBy))
+	case len(constraint) > 0 || len(floors) > 0:
+		versions, e := r.availableVersions(n.Name)
+		if e != nil {
+			err = e
+			return
+		}
+		var ok bool
+		if version, ok = append(constraint, floors...).highest(versions); ok {
+			return
+		}
+		if len(constraint) > 0 {
+			if version, ok = constraint.highest(versions); ok {
+				log.Debugf("%s@%s: below the versions go.mod files require\n", n.Name, version)
+				return
+			}
+		}
+		err = r.conflict(n, requirers, "no version matches every constraint")
+	case isSeedPackage(n.Name):
+		version = "latest"
+	case SeedProxy != "":
+		// the newest listed version, proxies have no branches
+		versions, e := r.availableVersions(n.Name)
+		if e != nil {
+			err = e
+			return
+		}
+		if version = latestVersion(versions); version == "" {
+			version = "latest"
+		}
+	default:
+		version = "master"
+	}
+	return
+}
+
+func (r *seedResolver) conflict(n *seedNode, requirers []string, reason string) error {
+	lines := []string{fmt.Sprintf("conflict on %s: %s", n.Name, reason)}
+	for _, requirer := range requirers {
+		req := n.Requires[requirer]
+		constraint := req.Constraint
+		if constraint == "" {
+			constraint = "any version"
+		}
+		lines = append(lines, fmt.Sprintf("    %s required by %s", constraint, strings.Join(req.Chain, " -> ")))
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "\n"))
+}
+
+// resolve builds the graph of dependencies and returns every package with
+// its chosen version. Packages are expanded (fetched to read their
+// Seedfile and imports) at the version currently chosen and expanded
+// again when new requirements move that version, until nothing changes.
+// Repositories failing to expand are left out of packages and returned as
+// seedErrors.
+func (r *seedResolver) resolve(dependencies []string) (packages []seedResolved, err error) {
+	for _, dependence := range dependencies {
+		name, version, checksum := splitDependency(dependence)
+		pinChecksum(name, version, checksum)
+		r.require(name, seedRootRequirer, version, false, []string{seedRootRequirer})
+	}
+
+	// repositories whose last expansion failed
+	broken := map[string]error{}
+
+	for round := 0; ; round++ {
+		if round > 10*len(r.nodes)+10 {
+			err = fmt.Errorf("dependencies do not settle on a set of versions")
+			return
+		}
+
+		var conflicts []string
+		var pending []*seedNode
+		var versions []string
+		live := r.reachable()
+		for _, name := range r.names() {
+			n := r.nodes[name]
+			if !live[name] {
+				continue
+			}
+			version, e := r.choose(n, live)
+			if e != nil {
+				conflicts = append(conflicts, e.Error())
+				continue
+			}
+			if n.expanded && n.Version == version {
+				continue
+			}
+			pending = append(pending, n)
+			versions = append(versions, version)
+		}
+		if len(pending) == 0 {
+			if len(conflicts) > 0 {
+				// report the repositories that failed to fetch as well
+				for _, name := range r.names() {
+					if e, ok := broken[name]; ok && live[name] {
+						conflicts = append(conflicts, stageError(name, stageFetch, e).Error())
+					}
+				}
+				err = fmt.Errorf("%s", strings.Join(conflicts, "\n"))
+				return
+			}
+			break
+		}
+
+		// expand every pending repository at once, the graph is only
+		// changed afterwards and in name order so the result does not
+		// depend on which fetch ends first
+		deps := make([][]seedDependency, len(pending))
+		errs := parallel(len(pending), r.jobs, func(i int) (err error) {
+			deps[i], err = r.expand(pending[i], versions[i])
+			return
+		})
+		for i, n := range pending {
+			if errs[i] != nil {
+				// a repository failing to expand is not expanded again at
+				// the same version, the rest of the graph still resolves
+				broken[n.Name] = errs[i]
+				n.Version, n.expanded = versions[i], true
+				continue
+			}
+			delete(broken, n.Name)
+			for _, d := range n.deps {
+				delete(r.nodes[repoRoot(d.Name)].Requires, n.Name)
+			}
+			n.Version, n.deps, n.expanded = versions[i], deps[i], true
+
+			chain := append(r.chain(n, live), fmt.Sprintf("%s@%s", n.Name, n.Version))
+			for _, d := range deps[i] {
+				pinChecksum(d.Name, d.Constraint, d.Checksum)
+				r.require(d.Name, n.Name, d.Constraint, d.Module, chain)
+			}
+		}
+	}
+
+	var failed seedErrors
+	live := r.reachable()
+	for _, cycle := range r.cycles(live) {
+		log.Warningln("dependency cycle:", strings.Join(cycle, " -> "))
+	}
+	for _, name := range r.names() {
+		if !live[name] {
+			continue
+		}
+		if e, ok := broken[name]; ok {
+			failed.add(name, stageFetch, e)
+			continue
+		}
+		n := r.nodes[name]
+		packages = append(packages, seedResolved{Name: name, Version: n.Version, Chain: r.chain(n, live)})
+	}
+	err = failed.err()
+	return
+}
+
+// cycles returns every cycle between live repositories, each one starting
+// and ending on the same repository.
+func (r *seedResolver) cycles(live map[string]bool) (cycles [][]string) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var stack []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, d := range r.nodes[name].deps {
+			next := repoRoot(d.Name)
+			switch state[next] {
+			case visiting:
+				for i := range stack {
+					if stack[i] == next {
+						cycle := append(append([]string{}, stack[i:]...), next)
+						cycles = append(cycles, cycle)
+						break
+					}
+				}
+			case 0:
+				if live[next] {
+					visit(next)
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = done
+	}
+	for _, name := range r.names() {
+		if live[name] && state[name] == 0 {
+			visit(name)
+		}
+	}
+	return
+}
+
+// chain is the path of requirers leading to n, taken from its first live
+// requirer.
+func (r *seedResolver) chain(n *seedNode, live map[string]bool) []string {
+	requirers := r.requirements(n, live)
+	if len(requirers) == 0 {
+		return nil
+	}
+	chain := n.Requires[requirers[0]].Chain
+	return append([]string{}, chain...)
+}
+
+// availableVersions lists the versions a constraint can pick from: git
+// tags (or module versions on the proxy) or the versions published on the
+// seed sources.
+func availableVersions(repo string) (versions []string, err error) {
+	if isSeedPackage(repo) {
+		versions, err = seedVersions(repo)
+		return
+	}
+	if SeedProxy != "" {
+		versions, err = proxyVersions(repo)
+		if err != nil {
+			err = stageError(repo, stageFetch, err)
+		}
+		return
+	}
+	versions, err = gitTags(repo)
+	return
+}
+
+// expand fetches the repository of n at version and lists what its
+// required packages need: the dependencies of the repository Seedfile and
+// every remote import outside of the repository.
+func (r *seedResolver) expand(n *seedNode, version string) (deps []seedDependency, err error) {
+	name := n.Name
+	var seedfile, gomod []byte
+	var list func(pkg string) ([]string, error)
+	if isSeedPackage(name) {
+		var archive map[string][]string
+		seedfile, gomod, archive, err = readSeedArchive(name, version)
+		if err != nil {
+			return
+		}
+		list = func(pkg string) ([]string, error) {
+			return archive[pkg], nil
+		}
+	} else {
+		key := fmt.Sprintf("%s@%s", name, version)
+		r.mu.Lock()
+		repoFolder, ok := r.checkouts[key]
+		r.mu.Unlock()
+		if !ok {
+			if SeedProxy != "" {
+				repoFolder, _, _, err = fetchModule(name, version, "")
+			} else {
+				repoFolder, _, err = checkoutRepo(name, version)
+			}
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			r.checkouts[key] = repoFolder
+			r.mu.Unlock()
+		}
+		seedfile, _ = ioutil.ReadFile(fmt.Sprintf("%s/Seedfile", repoFolder))
+		gomod, _ = ioutil.ReadFile(filepath.Join(repoFolder, goModFile))
+		list = func(pkg string) ([]string, error) {
+			return dirImports(filepath.Join(repoFolder, strings.TrimPrefix(pkg, name)))
+		}
+	}
+
+	// packages of the repository imported by the required ones are
+	// followed too
+	var imports []string
+	queue := n.packages()
+	for i := 0; i < len(queue); i++ {
+		pkgImports, e := list(queue[i])
+		if e != nil {
+			err = stageError(queue[i], stageList, e)
+			return
+		}
+		for _, p := range pkgImports {
+			if repoRoot(p) == name && !n.Packages[p] {
+				n.Packages[p] = true
+				queue = append(queue, p)
+			}
+		}
+		imports = append(imports, pkgImports...)
+	}
+
+	seen := map[string]bool{}
+	if seedfile != nil {
+		var config SeedConfig
+		if _, e := toml.Decode(string(seedfile), &config); e != nil {
+			log.Warningf("%s@%s: invalid Seedfile: %s\n", name, version, e)
+		}
+		for _, dependence := range config.Package.Dependencies {
+			d, v, sum := splitDependency(dependence)
+			if !seen[d] && repoRoot(d) != name {
+				seen[d] = true
+				deps = append(deps, seedDependency{Name: d, Constraint: v, Checksum: sum})
+			}
+		}
+	}
+	// the go.mod of the repository tells the lowest version of the
+	// modules it was built with
+	var requires []seedModRequire
+	if gomod != nil {
+		requires = parseModFile(gomod).Require
+	}
+	for _, p := range imports {
+		if p != "" && !seen[p] && repoRoot(p) != name {
+			seen[p] = true
+			deps = append(deps, seedDependency{Name: p, Constraint: moduleConstraint(requires, p), Module: true})
+		}
+	}
+	return
+}
+
+// moduleConstraint is the constraint a go.mod puts on the package pkg:
+// at least the version required for the module holding it, below its next
+// major version as the module path would change. Pseudo versions do not
+// constrain.
+func moduleConstraint(requires []seedModRequire, pkg string) (constraint string) {
+	best := ""
+	for _, r := range requires {
+		if (pkg == r.Path || strings.HasPrefix(pkg, r.Path+"/")) && len(r.Path) > len(best) {
+			best = r.Path
+			v := strings.TrimSuffix(r.Version, "+incompatible")
+			constraint = ""
+			if parsed, ok := parseVersion(v); ok && !strings.Contains(parsed.Pre, "-") && !strings.HasPrefix(parsed.Pre, "0.") {
+				constraint = fmt.Sprintf(">=%s,<v%d.0.0", v, parsed.Major+1)
+			}
+		}
+	}
+	return
+}
+
+// readSeedArchive reads the Seedfile, the go.mod and the remote imports of every
+// package of a seed package, keyed by import path, straight from its
+// archive on the cache.
+func readSeedArchive(repo, version string) (seedfile, gomod []byte, imports map[string][]string, err error) {
+	names := strings.Split(repo, "/")
+	if len(names) < 3 {
+		err = fmt.Errorf("invalid seed package: %s", repo)
+		return
+	}
+	zipPath, resolved, err := fetchSeed(names[1], names[2], version)
+	if err != nil {
+		return
+	}
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+
+	top := fmt.Sprintf("%s-%s-%s", names[1], names[2], resolved)
+	fset := token.NewFileSet()
+	all := map[string][]string{}
+	for _, f := range zr.File {
+		rel := strings.TrimPrefix(strings.TrimPrefix(f.Name, top), "/")
+		if rel == "Seedfile" {
+			seedfile, err = readZipFile(f)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if rel == goModFile {
+			gomod, err = readZipFile(f)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if !strings.HasSuffix(rel, ".go") || strings.HasSuffix(rel, "_test.go") {
+			continue
+		}
+		src, e := readZipFile(f)
+		if e != nil {
+			err = e
+			return
+		}
+		file, e := parser.ParseFile(fset, rel, src, parser.ImportsOnly)
+		if e != nil {
+			continue
+		}
+		pkg := repo
+		if dir := path.Dir(rel); dir != "." {
+			pkg = fmt.Sprintf("%s/%s", repo, dir)
+		}
+		for _, spec := range file.Imports {
+			if p, e := strconv.Unquote(spec.Path.Value); e == nil {
+				all[pkg] = append(all[pkg], p)
+			}
+		}
+	}
+
+	imports = map[string][]string{}
+	for pkg, list := range all {
+		imports[pkg] = externalImports(list)
+	}
+	return
+}
+
+func readZipFile(f *zip.File) (b []byte, err error) {
+	if f.UncompressedSize64 > seedMaxEntrySize {
+		err = fmt.Errorf("%s: entry too large (%d bytes)", f.Name, f.UncompressedSize64)
+		return
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	b, err = ioutil.ReadAll(io.LimitReader(rc, seedMaxEntrySize))
+	return
+}
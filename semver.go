@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// seedVersion is a semantic version, Parts tells how many of major,
+// minor and patch were written ("1.2" has 2).
+type seedVersion struct {
+	Major, Minor, Patch int
+	Pre                 string
+	Parts               int
+}
+
+// parseVersion accepts versions as used on git tags and the seed index:
+// "v1.2.3", "1.2.3-rc.1", "1.2" or "1".
+func parseVersion(s string) (v seedVersion, ok bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		v.Pre = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return
+		}
+		*nums[i] = n
+	}
+	v.Parts = len(parts)
+	ok = true
+	return
+}
+
+func (v seedVersion) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s = fmt.Sprintf("%s-%s", s, v.Pre)
+	}
+	return s
+}
+
+// compare returns -1, 0 or 1, a pre-release sorts before its release.
+func (v seedVersion) compare(o seedVersion) int {
+	for _, d := range []int{v.Major - o.Major, v.Minor - o.Minor, v.Patch - o.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case v.Pre == o.Pre:
+		return 0
+	case v.Pre == "":
+		return 1
+	case o.Pre == "":
+		return -1
+	case v.Pre < o.Pre:
+		return -1
+	}
+	return 1
+}
+
+type versionComparator struct {
+	Op      string
+	Version seedVersion
+}
+
+func (c versionComparator) match(v seedVersion) bool {
+	r := v.compare(c.Version)
+	switch c.Op {
+	case "=":
+		return r == 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	}
+	return false
+}
+
+// seedConstraint is a list of comparators that must all match.
+type seedConstraint []versionComparator
+
+// parseConstraint reads "^1.2", "~0.3.1", ">=1.0,<2.0" or "=1.2.3". Anything
+// not starting with an operator is not a constraint, it stays a branch,
+// tag, commit or exact seed version.
+func parseConstraint(s string) (c seedConstraint, ok bool) {
+	if s == "" || !strings.ContainsAny(s[:1], "^~<>=") {
+		return
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		op := part
+		if i := strings.IndexAny(part, "0123456789v"); i >= 0 {
+			op = part[:i]
+		}
+		v, valid := parseVersion(part[len(op):])
+		op = strings.TrimSpace(op)
+		if !valid {
+			return nil, false
+		}
+		switch op {
+		case "^":
+			upper := seedVersion{Major: v.Major + 1}
+			switch {
+			case v.Major == 0 && v.Parts >= 2 && v.Minor > 0:
+				upper = seedVersion{Minor: v.Minor + 1}
+			case v.Major == 0 && v.Parts == 3:
+				upper = seedVersion{Minor: v.Minor, Patch: v.Patch + 1}
+			case v.Major == 0 && v.Parts == 2:
+				upper = seedVersion{Minor: 1}
+			}
+			c = append(c, versionComparator{">=", v}, versionComparator{"<", upper})
+		case "~":
+			upper := seedVersion{Major: v.Major, Minor: v.Minor + 1}
+			if v.Parts == 1 {
+				upper = seedVersion{Major: v.Major + 1}
+			}
+			c = append(c, versionComparator{">=", v}, versionComparator{"<", upper})
+		case "=", ">", ">=", "<", "<=":
+			c = append(c, versionComparator{op, v})
+		default:
+			return nil, false
+		}
+	}
+	ok = true
+	return
+}
+
+func (c seedConstraint) match(v seedVersion) bool {
+	if v.Pre != "" {
+		return false
+	}
+	for _, cmp := range c {
+		if !cmp.match(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// highest returns the greatest of versions matching c, versions that are
+// not semantic versions are ignored.
+func (c seedConstraint) highest(versions []string) (best string, ok bool) {
+	var bestVersion seedVersion
+	for _, s := range versions {
+		v, valid := parseVersion(s)
+		if !valid || !c.match(v) {
+			continue
+		}
+		if !ok || v.compare(bestVersion) > 0 {
+			best, bestVersion, ok = s, v, true
+		}
+	}
+	return
+}
+
+// latestVersion is the highest release of versions, falling back to the
+// last one when none is a semantic version.
+func latestVersion(versions []string) string {
+	if v, ok := (seedConstraint{}).highest(versions); ok {
+		return v
+	}
+	if len(versions) == 0 {
+		return ""
+	}
+	return versions[len(versions)-1]
+}
@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"v1.2.3", "1.2.3", true},
+		{"1.2", "1.2.0", true},
+		{"1", "1.0.0", true},
+		{"1.2.3-rc.1", "1.2.3-rc.1", true},
+		{"1.2.3+build", "1.2.3", true},
+		{"1.2.3.4", "", false},
+		{"master", "", false},
+		{"1.x", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		v, ok := parseVersion(tt.in)
+		if ok != tt.ok || (ok && v.String() != tt.want) {
+			t.Errorf("parseVersion(%q) = %s, %v, want %s, %v", tt.in, v, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		match      []string
+		noMatch    []string
+	}{
+		{"^1.2", []string{"1.2.0", "1.2.9", "1.9.0"}, []string{"1.1.9", "2.0.0", "1.3.0-rc.1"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.9"}, []string{"1.2.2", "2.0.0"}},
+		{"^0.3", []string{"0.3.0", "0.3.9"}, []string{"0.2.9", "0.4.0", "1.0.0"}},
+		{"^0.3.1", []string{"0.3.1", "0.3.9"}, []string{"0.3.0", "0.4.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.2", "0.0.4", "0.1.0"}},
+		{"^0.0", []string{"0.0.0", "0.0.9"}, []string{"0.1.0"}},
+		{"^0", []string{"0.0.1", "0.9.0"}, []string{"1.0.0"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.2.2", "1.3.0"}},
+		{"~1.2", []string{"1.2.0", "1.2.9"}, []string{"1.1.9", "1.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"0.9.0", "2.0.0"}},
+		{"~0.3.1", []string{"0.3.1", "0.3.9"}, []string{"0.3.0", "0.4.0"}},
+		{">=1.0,<2.0", []string{"1.0.0", "1.9.9"}, []string{"0.9.9", "2.0.0"}},
+		{">1.0, <=1.5", []string{"1.0.1", "1.5.0"}, []string{"1.0.0", "1.5.1"}},
+		{">= 1.0", []string{"1.0.0", "5.0.0"}, []string{"0.9.0"}},
+		{"=1.2.3", []string{"1.2.3", "v1.2.3"}, []string{"1.2.4"}},
+		{">=v0.1.0,<v2.0.0", []string{"v0.1.0", "v1.9.0"}, []string{"v2.0.0", "v0.0.9"}},
+	}
+	for _, tt := range tests {
+		c, ok := parseConstraint(tt.constraint)
+		if !ok {
+			t.Errorf("parseConstraint(%q) failed", tt.constraint)
+			continue
+		}
+		for _, s := range tt.match {
+			if v, _ := parseVersion(s); !c.match(v) {
+				t.Errorf("%q does not match %s", tt.constraint, s)
+			}
+		}
+		for _, s := range tt.noMatch {
+			if v, _ := parseVersion(s); c.match(v) {
+				t.Errorf("%q matches %s", tt.constraint, s)
+			}
+		}
+	}
+}
+
+func TestParseConstraintInvalid(t *testing.T) {
+	for _, s := range []string{"", "master", "1.2.3", "v1.2", "^", "^x", ">=1.0,master", "=>1.0", "!=1.0"} {
+		if c, ok := parseConstraint(s); ok {
+			t.Errorf("parseConstraint(%q) = %v, want not a constraint", s, c)
+		}
+	}
+}
+
+func TestHighest(t *testing.T) {
+	versions := []string{"master", "v0.9.0", "v1.0.0", "v1.2.0", "v1.10.0", "v1.11.0-rc.1", "v2.0.0", "v2.1.0"}
+	tests := []struct {
+		constraint string
+		want       string
+		ok         bool
+	}{
+		{"^1.0", "v1.10.0", true},
+		{"~1.2", "v1.2.0", true},
+		{"^0.9", "v0.9.0", true},
+		{">=1.0,<2.0", "v1.10.0", true},
+		{">=2.0", "v2.1.0", true},
+		{"<1.0", "v0.9.0", true},
+		{"^3.0", "", false},
+	}
+	for _, tt := range tests {
+		c, _ := parseConstraint(tt.constraint)
+		got, ok := c.highest(versions)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("highest(%q) = %q, %v, want %q, %v", tt.constraint, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestLatestVersion(t *testing.T) {
+	tests := []struct {
+		versions []string
+		want     string
+	}{
+		{[]string{"1.0", "1.10", "1.9", "2.0-rc.1"}, "1.10"},
+		{[]string{"master", "develop"}, "develop"},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := latestVersion(tt.versions); got != tt.want {
+			t.Errorf("latestVersion(%v) = %q, want %q", tt.versions, got, tt.want)
+		}
+	}
+}
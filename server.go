@@ -0,0 +1,592 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nuveo/log"
+)
+
+var (
+	SeedServerPath = fmt.Sprintf("%s/server", SeedPath)
+
+	validIndexName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+const (
+	// seedMaxPushBody is the largest /push body: an archive of
+	// seedMaxArchiveSize plus room for the metadata and signature.
+	seedMaxPushBody = seedMaxArchiveSize + 1<<20
+	// seedMaxRegisterBody is the largest /register body, and of the
+	// metadata of a push.
+	seedMaxRegisterBody = 1 << 20
+
+	seedReadHeaderTimeout = 10 * time.Second
+	seedReadTimeout       = 30 * time.Minute
+	seedWriteTimeout      = 30 * time.Minute
+	seedIdleTimeout       = 2 * time.Minute
+)
+
+// seedIndex is the storage behind `seed server`. Every package lives in
+// <Root>/<organization>/<name>/ with one zip per version and a
+// package.json holding the Seedfile metadata and the pushed versions.
+// When Tokens is not empty only requests carrying one of them may publish.
+type seedIndex struct {
+	Root   string
+	Tokens []string
+	mu     sync.Mutex
+}
+
+// seedIndexPackage is the package.json of a package. Owner is the
+// sha256 of the token which registered the name, only that token may
+// publish it afterwards. Checksums holds the "sha256:<hex>" of every
+// version archive and Signatures the signature of the signed ones.
+type seedIndexPackage struct {
+	Package    seedPackage
+	Versions   []string
+	Checksums  map[string]string `json:",omitempty"`
+	Signatures map[string]string `json:",omitempty"`
+	Owner      string            `json:",omitempty"`
+}
+
+type seedSearchResult struct {
+	Organization string
+	Name         string
+	Version      string
+	Description  string
+}
+
+type seedRegister struct {
+	Package seedPackage
+}
+
+type seedResponse struct {
+	Message string
+}
+
+func validIndexPath(parts ...string) (err error) {
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." || !validIndexName.MatchString(p) {
+			err = fmt.Errorf("invalid name: %q", p)
+			return
+		}
+	}
+	return
+}
+
+func (idx *seedIndex) authorized(token string) bool {
+	if len(idx.Tokens) == 0 {
+		return true
+	}
+	for _, t := range idx.Tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func tokenOwner(token string) string {
+	if token == "" {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func (pkg seedIndexPackage) ownedBy(token string) bool {
+	return pkg.Owner == "" || subtle.ConstantTimeCompare([]byte(pkg.Owner), []byte(tokenOwner(token))) == 1
+}
+
+func (idx *seedIndex) packagePath(org, name string) string {
+	return filepath.Join(idx.Root, org, name)
+}
+
+func (idx *seedIndex) zipPath(org, name, version string) string {
+	return filepath.Join(idx.packagePath(org, name), fmt.Sprintf("%s.zip", version))
+}
+
+func (idx *seedIndex) loadPackage(org, name string) (pkg seedIndexPackage, err error) {
+	b, err := ioutil.ReadFile(filepath.Join(idx.packagePath(org, name), "package.json"))
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(b, &pkg)
+	return
+}
+
+func (idx *seedIndex) savePackage(pkg seedIndexPackage) (err error) {
+	b, err := json.MarshalIndent(pkg, "", "  ")
+	if err != nil {
+		return
+	}
+	err = writeFileAtomic(filepath.Join(idx.packagePath(pkg.Package.Organization, pkg.Package.Name), "package.json"), b)
+	return
+}
+
+// store saves a pushed archive. Published versions are immutable, pushing
+// a version twice is rejected.
+func (idx *seedIndex) store(push seedPush, token, file string) (err error) {
+	p := push.Package
+	if err = validIndexPath(p.Organization, p.Name, p.Version); err != nil {
+		return
+	}
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		err = fmt.Errorf("file is not a zip archive: %s", err)
+		return
+	}
+	zr.Close()
+	if push.Signature != "" {
+		if sig, e := base64.StdEncoding.DecodeString(push.Signature); e != nil || len(sig) != ed25519.SignatureSize {
+			err = errors.New("signature is not a base64 ed25519 signature")
+			return
+		}
+	}
+	sum, err := archiveChecksum(file)
+	if err != nil {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	pkg, err := idx.loadPackage(p.Organization, p.Name)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if os.IsNotExist(err) {
+		pkg.Owner = tokenOwner(token)
+	}
+	if !pkg.ownedBy(token) {
+		err = errNotOwner
+		return
+	}
+	for _, v := range pkg.Versions {
+		if v == p.Version {
+			err = errVersionExists
+			return
+		}
+	}
+
+	err = os.MkdirAll(idx.packagePath(p.Organization, p.Name), os.ModePerm)
+	if err != nil {
+		return
+	}
+	if err = os.Chmod(file, 0644); err != nil {
+		return
+	}
+	err = os.Rename(file, idx.zipPath(p.Organization, p.Name, p.Version))
+	if err != nil {
+		return
+	}
+
+	pkg.Package = p
+	pkg.Versions = append(pkg.Versions, p.Version)
+	if pkg.Checksums == nil {
+		pkg.Checksums = map[string]string{}
+	}
+	pkg.Checksums[p.Version] = sum
+	if push.Signature != "" {
+		if pkg.Signatures == nil {
+			pkg.Signatures = map[string]string{}
+		}
+		pkg.Signatures[p.Version] = push.Signature
+	}
+	err = idx.savePackage(pkg)
+	return
+}
+
+// checksum is the checksum of an archive, computed for versions published
+// before checksums were recorded.
+func (idx *seedIndex) checksum(pkg seedIndexPackage, version string) (sum string, err error) {
+	if sum = pkg.Checksums[version]; sum != "" {
+		return
+	}
+	return archiveChecksum(idx.zipPath(pkg.Package.Organization, pkg.Package.Name, version))
+}
+
+// register reserves organization/name for the token owner, registering
+// again with the same token updates the metadata.
+func (idx *seedIndex) register(reg seedRegister, token string) (created bool, err error) {
+	p := reg.Package
+	if err = validIndexPath(p.Organization, p.Name); err != nil {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	pkg, err := idx.loadPackage(p.Organization, p.Name)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	created = os.IsNotExist(err)
+	if created {
+		pkg.Owner = tokenOwner(token)
+	}
+	if !pkg.ownedBy(token) {
+		err = errNotOwner
+		return
+	}
+
+	err = os.MkdirAll(idx.packagePath(p.Organization, p.Name), os.ModePerm)
+	if err != nil {
+		return
+	}
+	if !created {
+		p.Version = pkg.Package.Version
+	} else {
+		p.Version = ""
+	}
+	pkg.Package = p
+	err = idx.savePackage(pkg)
+	return
+}
+
+// search returns the packages matching every term of query on their
+// name, organization, description, keywords or categories.
+func (idx *seedIndex) search(query string) (results []seedSearchResult, err error) {
+	terms := strings.Fields(strings.ToLower(query))
+	files, err := filepath.Glob(filepath.Join(idx.Root, "*", "*", "package.json"))
+	if err != nil {
+		return
+	}
+	sort.Strings(files)
+
+	results = []seedSearchResult{}
+	for _, f := range files {
+		var pkg seedIndexPackage
+		b, e := ioutil.ReadFile(f)
+		if e != nil || json.Unmarshal(b, &pkg) != nil {
+			log.Warningln("search: skipping", f)
+			continue
+		}
+		p := pkg.Package
+		text := strings.ToLower(strings.Join([]string{
+			p.Organization,
+			p.Name,
+			p.Description,
+			strings.Join(p.Keywords, " "),
+			strings.Join(p.Categories, " "),
+		}, " "))
+		match := true
+		for _, t := range terms {
+			if !strings.Contains(text, t) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		results = append(results, seedSearchResult{
+			Organization: p.Organization,
+			Name:         p.Name,
+			Version:      latestVersion(pkg.Versions),
+			Description:  p.Description,
+		})
+	}
+	return
+}
+
+var (
+	errVersionExists = errors.New("version already published")
+	errNotOwner      = errors.New("package registered by another owner")
+)
+
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".seed-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), path)
+	return
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeMessage(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, seedResponse{Message: msg})
+}
+
+// requestToken is the auth token of r: the bearer token of the
+// Authorization header, or the Seed-Token header when Authorization
+// carries basic auth for a proxy in front of the index.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.Header.Get("Seed-Token")
+}
+
+// writeBodyError answers a request whose body could not be read.
+func writeBodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body larger than %s", byteSize(tooLarge.Limit)))
+		return
+	}
+	writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid request: %s", err))
+}
+
+// decodeBody decodes the JSON body of r, of at most limit bytes, into v.
+// It answers the request itself when the body is too large or invalid.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v); err != nil {
+		writeBodyError(w, err)
+		return false
+	}
+	return true
+}
+
+// receivePush reads the multipart body of a push (see seedClient.Push):
+// the metadata into push and the archive into a temporary file of the
+// storage, returned as file. Remove file once done with it.
+func (idx *seedIndex) receivePush(r *http.Request, push *seedPush) (file string, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return
+	}
+	part, err := mr.NextPart()
+	if err != nil {
+		return
+	}
+	if part.FormName() != "package" {
+		err = fmt.Errorf("expected the package field, got %q", part.FormName())
+		return
+	}
+	if err = json.NewDecoder(io.LimitReader(part, seedMaxRegisterBody)).Decode(push); err != nil {
+		return
+	}
+	if part, err = mr.NextPart(); err != nil {
+		return
+	}
+	if part.FormName() != "file" {
+		err = fmt.Errorf("expected the file field, got %q", part.FormName())
+		return
+	}
+	f, err := ioutil.TempFile(idx.Root, ".push-")
+	if err != nil {
+		return
+	}
+	file = f.Name()
+	_, err = io.Copy(f, part)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return
+}
+
+func (idx *seedIndex) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	// the token is checked before a byte of the body is read
+	token := requestToken(r)
+	if !idx.authorized(token) {
+		writeMessage(w, http.StatusUnauthorized, "invalid auth token")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, seedMaxPushBody)
+	var push seedPush
+	file, err := idx.receivePush(r, &push)
+	if file != "" {
+		defer os.Remove(file)
+	}
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	err = idx.store(push, token, file)
+	switch {
+	case err == errVersionExists:
+		writeMessage(w, http.StatusConflict, fmt.Sprintf("%s: %s", push.Package.PackageFullName(), err))
+		return
+	case err == errNotOwner:
+		writeMessage(w, http.StatusForbidden, fmt.Sprintf("%s: %s", push.Package.PackageFullName(), err))
+		return
+	case err != nil:
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Println("push:", push.Package.PackageFullName())
+	writeMessage(w, http.StatusCreated, fmt.Sprintf("%s published", push.Package.PackageFullName()))
+}
+
+func (idx *seedIndex) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMessage(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	token := requestToken(r)
+	if !idx.authorized(token) {
+		writeMessage(w, http.StatusUnauthorized, "invalid auth token")
+		return
+	}
+	// a name is reserved for a token, without one nothing would be
+	if token == "" {
+		writeMessage(w, http.StatusUnauthorized, "register requires an auth token, nothing was reserved")
+		return
+	}
+	var reg seedRegister
+	if !decodeBody(w, r, seedMaxRegisterBody, &reg) {
+		return
+	}
+
+	name := fmt.Sprintf("%s/%s", reg.Package.Organization, reg.Package.Name)
+	created, err := idx.register(reg, token)
+	switch {
+	case err == errNotOwner:
+		writeMessage(w, http.StatusForbidden, fmt.Sprintf("%s: %s", name, err))
+		return
+	case err != nil:
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !created {
+		writeMessage(w, http.StatusOK, fmt.Sprintf("%s updated", name))
+		return
+	}
+	log.Println("register:", name)
+	writeMessage(w, http.StatusCreated, fmt.Sprintf("%s registered", name))
+}
+
+func (idx *seedIndex) handleSearch(w http.ResponseWriter, r *http.Request) {
+	results, err := idx.search(r.URL.Query().Get("q"))
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// handlePackages serves /packages/<organization>/<name> with the package
+// metadata and /packages/<organization>/<name>/<version> with its archive.
+func (idx *seedIndex) handlePackages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMessage(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/packages/"), "/"), "/")
+	if len(parts) == 3 {
+		parts[2] = strings.TrimSuffix(parts[2], ".zip")
+	}
+	if (len(parts) != 2 && len(parts) != 3) || validIndexPath(parts...) != nil {
+		writeMessage(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	pkg, err := idx.loadPackage(parts[0], parts[1])
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("package %s/%s not found", parts[0], parts[1]))
+		return
+	}
+	if len(parts) == 2 {
+		pkg.Owner = ""
+		checksums := map[string]string{}
+		for _, v := range pkg.Versions {
+			if sum, e := idx.checksum(pkg, v); e == nil {
+				checksums[v] = sum
+			}
+		}
+		pkg.Checksums = checksums
+		writeJSON(w, http.StatusOK, pkg)
+		return
+	}
+
+	zipPath := idx.zipPath(parts[0], parts[1], parts[2])
+	sum, err := idx.checksum(pkg, parts[2])
+	if err != nil {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("version %s of %s/%s not found", parts[2], parts[0], parts[1]))
+		return
+	}
+	w.Header().Set(seedChecksumHeader, sum)
+	if sig := pkg.Signatures[parts[2]]; sig != "" {
+		w.Header().Set(seedSignatureHeader, sig)
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	http.ServeFile(w, r, zipPath)
+}
+
+func (idx *seedIndex) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push", idx.handlePush)
+	mux.HandleFunc("/register", idx.handleRegister)
+	mux.HandleFunc("/search", idx.handleSearch)
+	mux.HandleFunc("/packages/", idx.handlePackages)
+	mux.HandleFunc("/goseed.io/", idx.handleModules)
+	return mux
+}
+
+func runServer(server seedServer) (err error) {
+	idx := &seedIndex{Root: server.Path, Tokens: server.Tokens}
+	if idx.Root == "" {
+		idx.Root = SeedServerPath
+	}
+	err = os.MkdirAll(idx.Root, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	port := server.Port
+	if port == 0 {
+		port = 8080
+	}
+	addr := fmt.Sprintf(":%d", port)
+	log.Printf("seed index serving %s on %s://0.0.0.0%s\n", idx.Root, server.protocol(), addr)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           idx.Handler(),
+		ReadHeaderTimeout: seedReadHeaderTimeout,
+		ReadTimeout:       seedReadTimeout,
+		WriteTimeout:      seedWriteTimeout,
+		IdleTimeout:       seedIdleTimeout,
+	}
+	switch server.protocol() {
+	case "http":
+		err = srv.ListenAndServe()
+	case "https":
+		err = srv.ListenAndServeTLS(server.Cert, server.Key)
+	default:
+		err = fmt.Errorf("unsupported server protocol: %s", server.Protocol)
+	}
+	return
+}
+
+func (s seedServer) protocol() string {
+	if s.Protocol == "" {
+		return "http"
+	}
+	return strings.ToLower(s.Protocol)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nuveo/log"
+)
+
+// Signature policies, set with `signatures` on the [seed] section.
+const (
+	// signaturesVerify checks the archives of organizations with trusted
+	// keys, other unsigned archives are installed with a warning.
+	signaturesVerify = "verify"
+	// signaturesRequire refuses archives not signed by a trusted key of
+	// their organization.
+	signaturesRequire = "require"
+	// signaturesIgnore skips signature checks.
+	signaturesIgnore = "ignore"
+)
+
+var (
+	// SeedKeyPath is the ed25519 key push signs archives with.
+	SeedKeyPath = fmt.Sprintf("%s/seed.key", SeedPath)
+
+	// SeedSignatures is the signature policy and SeedTrust the public
+	// keys trusted to sign the packages of each organization.
+	SeedSignatures = signaturesVerify
+	SeedTrust      = map[string][]ed25519.PublicKey{}
+)
+
+// seedSignatureError is an archive refused by the signature policy.
+type seedSignatureError struct {
+	Key    string
+	Reason string
+}
+
+func (e *seedSignatureError) Error() string {
+	return fmt.Sprintf("signature of %s: %s", e.Key, e.Reason)
+}
+
+// generateKey writes a new signing key to path and returns its public
+// key, an existing key is only replaced when force is set.
+func generateKey(path string, force bool) (public string, err error) {
+	if _, err = os.Stat(path); err == nil && !force {
+		err = fmt.Errorf("%s already exists", path)
+		return
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return
+	}
+	err = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600)
+	if err != nil {
+		return
+	}
+	public = base64.StdEncoding.EncodeToString(pub)
+	return
+}
+
+func readKey(path string) (key ed25519.PrivateKey, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		err = fmt.Errorf("%s: invalid ed25519 key", path)
+		return
+	}
+	key = ed25519.NewKeyFromSeed(seed)
+	return
+}
+
+func parsePublicKey(s string) (key ed25519.PublicKey, err error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		err = fmt.Errorf("invalid ed25519 public key: %q", s)
+		return
+	}
+	key = ed25519.PublicKey(b)
+	return
+}
+
+// signArchive signs the archive at path with key, the signature is
+// base64 encoded.
+func signArchive(path string, key ed25519.PrivateKey) (signature string, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, b))
+	return
+}
+
+// signaturePath is where the signature of a cached archive is kept.
+func signaturePath(zipPath string) string {
+	return fmt.Sprintf("%s.sig", zipPath)
+}
+
+// verifySignature applies the signature policy to the archive of
+// org/name@version, its signature is read next to it on the cache.
+func verifySignature(zipPath, org, name, version string) (err error) {
+	if SeedSignatures == signaturesIgnore {
+		return
+	}
+	key := seedKey(org, name, version)
+	var signature []byte
+	if b, e := ioutil.ReadFile(signaturePath(zipPath)); e == nil {
+		signature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil {
+			err = &seedSignatureError{Key: key, Reason: "invalid signature"}
+			return
+		}
+	}
+	trusted := SeedTrust[org]
+
+	switch {
+	case signature == nil && (SeedSignatures == signaturesRequire || len(trusted) > 0):
+		err = &seedSignatureError{Key: key, Reason: "package is not signed"}
+		return
+	case signature == nil:
+		log.Warningf("%s is not signed\n", key)
+		return
+	case len(trusted) == 0 && SeedSignatures == signaturesRequire:
+		err = &seedSignatureError{Key: key, Reason: fmt.Sprintf("no trusted keys for organization %s", org)}
+		return
+	case len(trusted) == 0:
+		log.Debugf("%s is signed, no trusted keys for organization %s to check it\n", key, org)
+		return
+	}
+
+	b, err := ioutil.ReadFile(zipPath)
+	if err != nil {
+		return
+	}
+	for _, pub := range trusted {
+		if ed25519.Verify(pub, b, signature) {
+			log.Debugf("%s signature verified\n", key)
+			return
+		}
+	}
+	err = &seedSignatureError{Key: key, Reason: fmt.Sprintf("not signed by a trusted key of %s", org)}
+	return
+}
+
+// signaturesRank orders the policies from the weakest, unknown policies
+// rank highest so they still reach applyTrust and fail there.
+func signaturesRank(policy string) int {
+	switch policy {
+	case signaturesIgnore:
+		return 0
+	case "", signaturesVerify:
+		return 1
+	case signaturesRequire:
+		return 2
+	}
+	return 3
+}
+
+// applyTrust loads the policy and the trusted keys of every organization.
+func applyTrust(policy string, trust map[string][]string) (err error) {
+	switch policy {
+	case "":
+		policy = signaturesVerify
+	case signaturesVerify, signaturesRequire, signaturesIgnore:
+	default:
+		err = fmt.Errorf("unknown signatures policy %q, use %s, %s or %s", policy, signaturesVerify, signaturesRequire, signaturesIgnore)
+		return
+	}
+	SeedSignatures = policy
+
+	SeedTrust = map[string][]ed25519.PublicKey{}
+	for org, keys := range trust {
+		for _, k := range keys {
+			pub, e := parsePublicKey(k)
+			if e != nil {
+				err = fmt.Errorf("trust %s: %s", org, e)
+				return
+			}
+			SeedTrust[org] = append(SeedTrust[org], pub)
+		}
+	}
+	return
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nuveo/log"
+)
+
+// SeedSources are the configured indexes, in the order they are tried
+// when resolving a seed package.
+var SeedSources []seedClient
+
+// seedPins are the archive checksums pinned on Seedfiles, by
+// "org/name@version". Every pin of a version must match its archive.
+var (
+	seedPins   = map[string][]string{}
+	seedPinsMu sync.Mutex
+)
+
+func seedKey(org, name, version string) string {
+	return fmt.Sprintf("%s/%s@%s", org, name, version)
+}
+
+// pinChecksum records the checksum a Seedfile expects for the archive of
+// repo at version, only exact versions can be pinned.
+func pinChecksum(repo, version, checksum string) {
+	names := strings.Split(repo, "/")
+	if checksum == "" || !isSeedPackage(repo) || len(names) < 3 {
+		return
+	}
+	if _, ok := parseConstraint(version); ok || version == "" || version == "latest" {
+		log.Warningf("%s@%s: checksum ignored, it requires an exact version\n", repo, version)
+		return
+	}
+	key := seedKey(names[1], names[2], version)
+	seedPinsMu.Lock()
+	defer seedPinsMu.Unlock()
+	for _, sum := range seedPins[key] {
+		if sum == checksum {
+			return
+		}
+	}
+	seedPins[key] = append(seedPins[key], checksum)
+}
+
+// seedChecksumError is an archive not matching an expected checksum, it
+// is never worked around by trying another source.
+type seedChecksumError struct {
+	Key      string
+	Source   string
+	Expected string
+	Got      string
+}
+
+func (e *seedChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch on %s, %s expects %s got %s", e.Key, e.Source, e.Expected, e.Got)
+}
+
+func archiveChecksum(path string) (sum string, err error) {
+	sum, err = fileSHA256(path)
+	if err == nil {
+		sum = fmt.Sprintf("sha256:%s", sum)
+	}
+	return
+}
+
+// checkPins checks sum against every checksum pinned for key.
+func checkPins(key, sum string) (err error) {
+	seedPinsMu.Lock()
+	defer seedPinsMu.Unlock()
+	for _, pin := range seedPins[key] {
+		if pin != sum {
+			err = &seedChecksumError{Key: key, Source: "Seedfile", Expected: pin, Got: sum}
+			return
+		}
+	}
+	return
+}
+
+// verifyArchive checks a cached archive of org/name@version against the
+// checksum stored next to it when downloaded and against every pin.
+func verifyArchive(zipPath, org, name, version string) (err error) {
+	key := seedKey(org, name, version)
+	sum, err := archiveChecksum(zipPath)
+	if err != nil {
+		return
+	}
+	if b, e := ioutil.ReadFile(checksumPath(zipPath)); e == nil && strings.TrimSpace(string(b)) != sum {
+		err = &seedChecksumError{Key: key, Source: "cache", Expected: strings.TrimSpace(string(b)), Got: sum}
+		return
+	}
+	err = checkPins(key, sum)
+	return
+}
+
+// checksumPath is where the checksum published for a cached archive is
+// kept.
+func checksumPath(zipPath string) string {
+	return fmt.Sprintf("%s.sha256", zipPath)
+}
+
+func isSeedPackage(repo string) bool {
+	return strings.HasPrefix(repo, "goseed.io/")
+}
+
+// fetchSeed makes sure the archive of org/name@version is on the cache
+// and returns its path together with the concrete version, "latest"
+// resolves to the newest version of the first source having the package.
+// A cached archive is verified and used, otherwise sources are tried in
+// order and the first one having the version wins. Offline "latest" is the
+// newest version on the cache or on file:// sources.
+func fetchSeed(org, name, version string) (zipPath, resolved string, err error) {
+	if version == "latest" && SeedOffline {
+		versions, _ := seedVersions(fmt.Sprintf("goseed.io/%s/%s", org, name))
+		if version = latestVersion(versions); version == "" {
+			err = &seedOfflineError{What: seedKey(org, name, "latest")}
+			return
+		}
+	}
+	resolved = version
+	if version != "latest" {
+		zipPath = fmt.Sprintf("%s/%s-%s-%s.zip", SeedCachePath, org, name, version)
+		if _, err = os.Stat(zipPath); err == nil {
+			touchCache(zipPath)
+			err = verifyArchive(zipPath, org, name, version)
+			if err == nil {
+				err = verifySignature(zipPath, org, name, version)
+			}
+			return
+		}
+	}
+
+	if len(SeedSources) == 0 {
+		err = errors.New("no sources configured")
+		return
+	}
+	err = os.MkdirAll(SeedCachePath, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	var tried []string
+	for _, source := range SeedSources {
+		if SeedOffline && !isLocal(source.URL) {
+			continue
+		}
+		tried = append(tried, source.URL)
+		v := version
+		if v == "latest" {
+			pkg, e := source.Package(org, name)
+			if e != nil {
+				logSourceError(source, e)
+				continue
+			}
+			v = latestVersion(pkg.Versions)
+			if v == "" {
+				continue
+			}
+		}
+
+		zipPath = fmt.Sprintf("%s/%s-%s-%s.zip", SeedCachePath, org, name, v)
+		if e := downloadSeed(source, org, name, v, zipPath); e != nil {
+			if _, ok := e.(*seedChecksumError); ok {
+				err = e
+				return
+			}
+			logSourceError(source, e)
+			continue
+		}
+		log.Debugf("%s/%s@%s from %s\n", org, name, v, source.URL)
+		resolved = v
+		err = verifySignature(zipPath, org, name, v)
+		return
+	}
+	if SeedOffline && len(tried) == 0 {
+		err = &seedOfflineError{What: seedKey(org, name, version)}
+		return
+	}
+	err = fmt.Errorf("%s/%s@%s not found on sources: %s", org, name, version, strings.Join(tried, ", "))
+	return
+}
+
+// seedVersions lists every version of a seed package published on any of
+// the sources, offline those on the cache and on file:// sources.
+func seedVersions(repo string) (versions []string, err error) {
+	names := strings.Split(repo, "/")
+	if len(names) < 3 {
+		err = fmt.Errorf("invalid seed package: %s", repo)
+		return
+	}
+	seen := map[string]bool{}
+	if SeedOffline {
+		for _, v := range cachedSeedVersions(names[1], names[2]) {
+			seen[v] = true
+			versions = append(versions, v)
+		}
+	}
+	for _, source := range SeedSources {
+		if SeedOffline && !isLocal(source.URL) {
+			continue
+		}
+		pkg, e := source.Package(names[1], names[2])
+		if e != nil {
+			logSourceError(source, e)
+			continue
+		}
+		for _, v := range pkg.Versions {
+			if !seen[v] {
+				seen[v] = true
+				versions = append(versions, v)
+			}
+		}
+	}
+	return
+}
+
+func logSourceError(source seedClient, err error) {
+	if isNotFound(err) {
+		log.Debugln(err)
+		return
+	}
+	log.Warningln(err)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nuveo/log"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+)
+
+// Modules downloaded from a proxy that neither go.sum nor Seedfile.lock
+// know yet are looked up on the checksum database, as the go tool does.
+// GOSUMDB, GONOSUMDB and GOPRIVATE are read the same way: GOSUMDB=off or a
+// module matching GONOSUMDB (GOPRIVATE when unset) is not looked up, and
+// nothing is looked up offline. The verified tree and its tiles are kept
+// on <cache>/sumdb.
+
+// seedSumDBKey is the verifier key of sum.golang.org.
+const seedSumDBKey = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8"
+
+var (
+	sumDBOnce   sync.Once
+	sumDBClient *sumdb.Client
+	sumDBName   string
+	sumDBErr    error
+)
+
+// sumDB returns the checksum database client for modPath, or why the
+// module is not looked up.
+func sumDB(modPath string) (client *sumdb.Client, name string, skip string) {
+	switch {
+	case strings.TrimSpace(os.Getenv("GOSUMDB")) == "off":
+		skip = "GOSUMDB=off"
+		return
+	case module.MatchPrefixPatterns(noSumDBPatterns(), modPath):
+		skip = "it matches GONOSUMDB"
+		return
+	case SeedOffline:
+		skip = "offline"
+		return
+	}
+	sumDBOnce.Do(func() {
+		var ops *seedSumDBOps
+		if ops, sumDBErr = newSumDBOps(os.Getenv("GOSUMDB")); sumDBErr == nil {
+			sumDBClient, sumDBName = sumdb.NewClient(ops), ops.name
+		}
+	})
+	if sumDBErr != nil {
+		skip = sumDBErr.Error()
+		return
+	}
+	client, name = sumDBClient, sumDBName
+	return
+}
+
+func noSumDBPatterns() string {
+	if patterns := os.Getenv("GONOSUMDB"); patterns != "" {
+		return patterns
+	}
+	return os.Getenv("GOPRIVATE")
+}
+
+// checkSumDB checks the hashes of a module version against the checksum
+// database. A module that cannot be looked up is warned about.
+func checkSumDB(modPath, version, sum, modFile string) (err error) {
+	key := fmt.Sprintf("%s@%s", modPath, version)
+	client, name, skip := sumDB(modPath)
+	if client == nil {
+		log.Warningf("%s is not on %s and the checksum database is not used (%s), it is not verified\n", key, goSumFile, skip)
+		return
+	}
+	lines, err := client.Lookup(modPath, version)
+	if err != nil {
+		err = fmt.Errorf("%s: checksum database %s: %s", key, name, err)
+		return
+	}
+	b, err := ioutil.ReadFile(modFile)
+	if err != nil {
+		return
+	}
+	modSum, err := hashGoMod(b)
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		f := strings.Fields(line)
+		switch {
+		case len(f) != 3 || f[0] != modPath:
+		case f[1] == version && f[2] != sum:
+			err = &seedChecksumError{Key: key, Source: name, Expected: f[2], Got: sum}
+			return
+		case f[1] == version+"/go.mod" && f[2] != modSum:
+			err = &seedChecksumError{Key: key + "/go.mod", Source: name, Expected: f[2], Got: modSum}
+			return
+		}
+	}
+	log.Debugf("%s verified on %s\n", key, name)
+	return
+}
+
+// seedSumDBOps lets sumdb.Client talk to the database at url and keep
+// its state on the cache.
+type seedSumDBOps struct {
+	name, key, url string
+	mu             sync.Mutex
+}
+
+// newSumDBOps reads GOSUMDB: "sum.golang.org" (the default), or
+// "<name>+<hash>+<key> [url]". Unless an url is given the database is
+// reached through the proxy when it supports it.
+func newSumDBOps(gosumdb string) (ops *seedSumDBOps, err error) {
+	f := strings.Fields(gosumdb)
+	if len(f) == 0 {
+		f = []string{"sum.golang.org"}
+	}
+	ops = &seedSumDBOps{key: f[0]}
+	if ops.key == "sum.golang.org" {
+		ops.key = seedSumDBKey
+	}
+	ops.name = strings.SplitN(ops.key, "+", 2)[0]
+	if !strings.Contains(ops.key, "+") {
+		err = fmt.Errorf("GOSUMDB %s: unknown database, set its key", ops.name)
+		return
+	}
+	switch {
+	case len(f) > 1:
+		ops.url = strings.TrimRight(f[1], "/")
+	case strings.HasPrefix(SeedProxy, "http://") || strings.HasPrefix(SeedProxy, "https://"):
+		ops.url = fmt.Sprintf("https://%s", ops.name)
+		proxied := fmt.Sprintf("%s/sumdb/%s", SeedProxy, ops.name)
+		if resp, e := seedHTTPClient.Get(proxied + "/supported"); e == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				ops.url = proxied
+			}
+		}
+	default:
+		ops.url = fmt.Sprintf("https://%s", ops.name)
+	}
+	return
+}
+
+func (o *seedSumDBOps) ReadRemote(path string) (b []byte, err error) {
+	u := o.url + path
+	resp, err := seedHTTPClient.Get(u)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		err = &seedStatusError{URL: u, Message: strings.TrimSpace(string(b)), StatusCode: resp.StatusCode}
+		b = nil
+		return
+	}
+	b, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return
+}
+
+func (o *seedSumDBOps) path(file string) string {
+	return filepath.Join(SeedCachePath, "sumdb", filepath.FromSlash(file))
+}
+
+// ReadConfig returns the key and the latest verified tree, nothing when
+// the database was never used.
+func (o *seedSumDBOps) ReadConfig(file string) (b []byte, err error) {
+	if file == "key" {
+		return []byte(o.key), nil
+	}
+	b, err = ioutil.ReadFile(o.path(file))
+	if os.IsNotExist(err) {
+		b, err = []byte{}, nil
+	}
+	return
+}
+
+func (o *seedSumDBOps) WriteConfig(file string, old, new []byte) (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	current, err := o.ReadConfig(file)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(current, old) {
+		return sumdb.ErrWriteConflict
+	}
+	if err = os.MkdirAll(filepath.Dir(o.path(file)), os.ModePerm); err != nil {
+		return
+	}
+	err = writeFileAtomic(o.path(file), new)
+	return
+}
+
+func (o *seedSumDBOps) ReadCache(file string) ([]byte, error) {
+	return ioutil.ReadFile(o.path(file))
+}
+
+func (o *seedSumDBOps) WriteCache(file string, data []byte) {
+	if os.MkdirAll(filepath.Dir(o.path(file)), os.ModePerm) == nil {
+		_ = writeFileAtomic(o.path(file), data)
+	}
+}
+
+func (o *seedSumDBOps) Log(msg string) {
+	log.Debugln(msg)
+}
+
+func (o *seedSumDBOps) SecurityError(msg string) {
+	log.Errorln(msg)
+}